@@ -0,0 +1,409 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// 集群事件类型
+const (
+	busEventMessage = "message" // 转发给其他节点上的WebSocket客户端的消息
+	busEventMeta    = "meta"    // 会话元数据字段的变化
+)
+
+// 发布队列长度。队列已满时丢弃转发的消息，元数据事件暂存并合并，避免在持有会话锁时阻塞
+const busQueueSize = 4096
+
+// 集群中各节点之间传递的事件
+type busEvent struct {
+	Node       string          `json:"node"`
+	SessionID  string          `json:"sessionID"`
+	Kind       string          `json:"kind"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	Recipients []string        `json:"recipients,omitempty"` // 消息的接收方客户端ID，为空表示所有人
+	SenderID   string          `json:"senderID,omitempty"`   // 定向消息的发送方客户端ID
+	Priority   bool            `json:"priority,omitempty"`   // 消息优先发送
+	Coalesce   string          `json:"coalesce,omitempty"`   // 消息的合并键
+	Field      string          `json:"field,omitempty"`      // 元数据字段
+	Deleted    bool            `json:"deleted,omitempty"`    // 元数据字段被删除
+
+	seq uint64 // 在本节点发布队列中的序号
+}
+
+// 暂存的元数据事件的合并键
+type metaKey struct {
+	sessionID string
+	field     string // 为空表示删除整个会话
+}
+
+// MessageBus 在服务器节点之间广播会话事件。发布者自己也会收到事件，订阅方需要忽略本节点发出的事件
+type MessageBus interface {
+	Publish(event busEvent) error
+	Subscribe(handler func(busEvent)) error
+	Close() error
+}
+
+// SessionMetaStore 保存会话元数据（文字内容、文件列表、客户端密钥、各节点的在线列表等），
+// 多个节点共享同一份数据，新节点加入会话时从中加载
+type SessionMetaStore interface {
+	Put(sessionID, field string, value []byte) error
+	Delete(sessionID string, fields ...string) error
+	Load(sessionID string) (map[string][]byte, error)
+	Drop(sessionID string) error
+}
+
+// 当前节点的集群后端
+type clusterBackend struct {
+	nodeID string
+	bus    MessageBus
+	meta   SessionMetaStore
+	queue  chan busEvent
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	queued uint64 // 已加入发布队列的事件数
+
+	// 发布队列已满时暂存的元数据事件，按加入顺序排列，同一字段只保留最新的变化
+	deferred     *list.List
+	deferredKeys map[metaKey]*list.Element
+	deferredFrom uint64        // 开始暂存时已加入发布队列的事件数，这些事件发布后才能写入暂存的事件
+	deferredWake chan struct{} // 有新的暂存事件时唤醒发布协程
+}
+
+// 默认使用进程内的消息总线和元数据存储，单节点部署时无需额外服务
+var cluster = newClusterBackend(defaultNodeID(), newMemoryBus(), newMemoryMetaStore())
+
+func newClusterBackend(nodeID string, bus MessageBus, meta SessionMetaStore) *clusterBackend {
+	return &clusterBackend{
+		nodeID: nodeID,
+		bus:    bus,
+		meta:   meta,
+		queue:  make(chan busEvent, busQueueSize),
+		done:   make(chan struct{}),
+
+		deferred:     list.New(),
+		deferredKeys: make(map[metaKey]*list.Element),
+		deferredWake: make(chan struct{}, 1),
+	}
+}
+
+// 默认节点ID：主机名加随机后缀，同一主机上运行多个实例时也不会冲突
+func defaultNodeID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "node"
+	}
+	return hostname + "-" + generateUUID()[:8]
+}
+
+// 根据配置初始化集群后端，订阅其他节点的事件并启动发布队列
+func initCluster() error {
+	nodeID := serverConfig.NodeID
+	if nodeID == "" {
+		nodeID = defaultNodeID()
+	}
+
+	switch serverConfig.Bus {
+	case "", "memory":
+		cluster = newClusterBackend(nodeID, newMemoryBus(), newMemoryMetaStore())
+	case "redis":
+		backend, err := newRedisBackend(serverConfig.RedisAddr, serverConfig.RedisPassword, serverConfig.RedisDB, serverConfig.RedisPrefix)
+		if err != nil {
+			return fmt.Errorf("连接Redis失败: %v", err)
+		}
+		cluster = newClusterBackend(nodeID, backend, backend)
+	default:
+		return fmt.Errorf("不支持的消息总线: %s", serverConfig.Bus)
+	}
+
+	if err := cluster.bus.Subscribe(handleBusEvent); err != nil {
+		return fmt.Errorf("订阅消息总线失败: %v", err)
+	}
+	go cluster.run()
+
+	log.Printf("集群节点 %s 已启动，消息总线: %s", nodeID, serverConfig.Bus)
+	return nil
+}
+
+// 按顺序写入元数据并发布事件。写入共享存储和发布都可能涉及网络IO，因此不在会话锁内进行
+func (b *clusterBackend) run() {
+	defer close(b.done)
+
+	var published uint64
+	for {
+		select {
+		case event, ok := <-b.queue:
+			if !ok {
+				// 队列已关闭，写入剩余的暂存事件后退出
+				for _, event := range b.takeDeferred(published) {
+					b.publish(event)
+				}
+				return
+			}
+			b.publish(event)
+			published = event.seq
+		case <-b.deferredWake:
+		}
+
+		for _, event := range b.takeDeferred(published) {
+			b.publish(event)
+		}
+	}
+}
+
+// 写入元数据事件对应的共享存储并发布事件
+func (b *clusterBackend) publish(event busEvent) {
+	if event.Kind == busEventMeta {
+		var err error
+		switch {
+		case event.Field == "":
+			err = b.meta.Drop(event.SessionID)
+		case event.Deleted:
+			err = b.meta.Delete(event.SessionID, event.Field)
+		default:
+			err = b.meta.Put(event.SessionID, event.Field, event.Data)
+		}
+		if err != nil {
+			log.Printf("保存会话元数据失败 %s/%s: %v", event.SessionID, event.Field, err)
+		}
+	}
+	if err := b.bus.Publish(event); err != nil {
+		log.Printf("发布集群事件失败: %v", err)
+	}
+}
+
+// 将事件加入发布队列。转发的消息在队列已满时丢弃；元数据事件丢弃后各节点的共享数据会永久不一致，
+// 因此暂存起来，等之前加入队列的事件发布后再写入
+func (b *clusterBackend) enqueue(event busEvent) {
+	event.Node = b.nodeID
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	// 已有暂存的元数据事件时，之后的元数据事件也需要暂存，保证同一字段的变化按顺序写入
+	if event.Kind == busEventMeta && b.deferred.Len() > 0 {
+		b.deferMeta(event)
+		return
+	}
+
+	event.seq = b.queued + 1
+	select {
+	case b.queue <- event:
+		b.queued++
+	default:
+		if event.Kind == busEventMeta {
+			b.deferMeta(event)
+			return
+		}
+		log.Printf("警告: 集群发布队列已满，丢弃会话 %s 的事件", event.SessionID)
+	}
+}
+
+// 暂存元数据事件，调用方需持有b.mu。同一字段只保留最新的变化；删除整个会话时，之前暂存的该会话的字段无需再写入
+func (b *clusterBackend) deferMeta(event busEvent) {
+	if b.deferred.Len() == 0 {
+		b.deferredFrom = b.queued
+		log.Printf("警告: 集群发布队列已满，暂存会话 %s 的元数据变化", event.SessionID)
+	}
+
+	key := metaKey{sessionID: event.SessionID, field: event.Field}
+	if event.Field == "" {
+		for e := b.deferred.Front(); e != nil; {
+			next := e.Next()
+			if pending := e.Value.(busEvent); pending.SessionID == event.SessionID {
+				b.deferred.Remove(e)
+				delete(b.deferredKeys, metaKey{sessionID: pending.SessionID, field: pending.Field})
+			}
+			e = next
+		}
+	} else if e, exists := b.deferredKeys[key]; exists {
+		b.deferred.Remove(e)
+	}
+	b.deferredKeys[key] = b.deferred.PushBack(event)
+
+	select {
+	case b.deferredWake <- struct{}{}:
+	default:
+	}
+}
+
+// 之前加入队列的事件都已发布时（published为已发布的最后一个事件的序号），取出所有暂存的元数据事件
+func (b *clusterBackend) takeDeferred(published uint64) []busEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.deferred.Len() == 0 || published < b.deferredFrom {
+		return nil
+	}
+	events := make([]busEvent, 0, b.deferred.Len())
+	for e := b.deferred.Front(); e != nil; e = e.Next() {
+		events = append(events, e.Value.(busEvent))
+	}
+	b.deferred.Init()
+	b.deferredKeys = make(map[metaKey]*list.Element)
+	return events
+}
+
+// 发送完队列中的事件后关闭总线，服务关闭时调用
+func (b *clusterBackend) close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.queue)
+	b.mu.Unlock()
+
+	<-b.done
+	if err := b.bus.Close(); err != nil {
+		log.Printf("关闭消息总线失败: %v", err)
+	}
+}
+
+// 把消息发送给本节点和其他节点上的客户端。调用方需持有会话锁
+func fanOut(msg outboundMessage, session *Session, recipients []string, senderID string) {
+	cluster.enqueue(busEvent{
+		SessionID:  session.ID,
+		Kind:       busEventMessage,
+		Data:       msg.Data,
+		Recipients: recipients,
+		SenderID:   senderID,
+		Priority:   msg.Priority,
+		Coalesce:   msg.Coalesce,
+	})
+
+	if len(session.Clients) == 0 {
+		log.Println("警告: 尝试向没有客户端的会话广播消息")
+		return
+	}
+	deliverMessage(msg, session, recipients, senderID)
+}
+
+// 处理其他节点发布的事件
+func handleBusEvent(event busEvent) {
+	if event.Node == cluster.nodeID {
+		return
+	}
+
+	// 本节点没有该会话时无需处理，之后创建会话时会从共享存储加载元数据
+	session, exists := store.GetSession(event.SessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	switch event.Kind {
+	case busEventMessage:
+		if len(session.Clients) > 0 {
+			msg := outboundMessage{Data: event.Data, Priority: event.Priority, Coalesce: event.Coalesce}
+			deliverMessage(msg, session, event.Recipients, event.SenderID)
+		}
+	case busEventMeta:
+		session.applyMeta(event.Field, event.Data, event.Deleted)
+	}
+}
+
+// 进程内的消息总线：事件按发布顺序异步分发给所有订阅者
+type memoryBus struct {
+	mu       sync.Mutex
+	handlers []func(busEvent)
+	events   chan busEvent
+	once     sync.Once
+}
+
+func newMemoryBus() *memoryBus {
+	bus := &memoryBus{events: make(chan busEvent, busQueueSize)}
+	go bus.dispatch()
+	return bus
+}
+
+func (m *memoryBus) dispatch() {
+	for event := range m.events {
+		m.mu.Lock()
+		handlers := append([]func(busEvent){}, m.handlers...)
+		m.mu.Unlock()
+
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+func (m *memoryBus) Publish(event busEvent) error {
+	m.events <- event
+	return nil
+}
+
+func (m *memoryBus) Subscribe(handler func(busEvent)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers = append(m.handlers, handler)
+	return nil
+}
+
+func (m *memoryBus) Close() error {
+	m.once.Do(func() { close(m.events) })
+	return nil
+}
+
+// 进程内的会话元数据存储
+type memoryMetaStore struct {
+	mu       sync.Mutex
+	sessions map[string]map[string][]byte
+}
+
+func newMemoryMetaStore() *memoryMetaStore {
+	return &memoryMetaStore{sessions: make(map[string]map[string][]byte)}
+}
+
+func (m *memoryMetaStore) Put(sessionID, field string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fields, exists := m.sessions[sessionID]
+	if !exists {
+		fields = make(map[string][]byte)
+		m.sessions[sessionID] = fields
+	}
+	fields[field] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryMetaStore) Delete(sessionID string, fields ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, field := range fields {
+		delete(m.sessions[sessionID], field)
+	}
+	return nil
+}
+
+func (m *memoryMetaStore) Load(sessionID string) (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fields := make(map[string][]byte, len(m.sessions[sessionID]))
+	for field, value := range m.sessions[sessionID] {
+		fields[field] = append([]byte(nil), value...)
+	}
+	return fields, nil
+}
+
+func (m *memoryMetaStore) Drop(sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, sessionID)
+	return nil
+}
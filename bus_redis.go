@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 单次Redis操作的超时时间
+const redisOpTimeout = 2 * time.Second
+
+// 会话元数据在Redis中的保留时间，每次写入时刷新。节点崩溃后残留的数据会在过期后清除
+const redisMetaTTL = 24 * time.Hour
+
+// 基于Redis的集群后端：事件通过发布/订阅频道广播，会话元数据保存在每个会话一个的哈希表中
+type redisBackend struct {
+	client *redis.Client
+	prefix string
+
+	mu     sync.Mutex
+	pubsub *redis.PubSub
+}
+
+func newRedisBackend(addr, password string, db int, prefix string) (*redisBackend, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisBackend{client: client, prefix: prefix}, nil
+}
+
+func (r *redisBackend) channel() string {
+	return r.prefix + "events"
+}
+
+func (r *redisBackend) sessionKey(sessionID string) string {
+	return r.prefix + "session:" + sessionID
+}
+
+func (r *redisBackend) Publish(event busEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return r.client.Publish(ctx, r.channel(), data).Err()
+}
+
+func (r *redisBackend) Subscribe(handler func(busEvent)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	pubsub := r.client.Subscribe(context.Background(), r.channel())
+	// 等待订阅确认，确保之后发布的事件不会丢失
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	r.mu.Lock()
+	r.pubsub = pubsub
+	r.mu.Unlock()
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			var event busEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("解析集群事件失败: %v", err)
+				continue
+			}
+			handler(event)
+		}
+	}()
+	return nil
+}
+
+func (r *redisBackend) Close() error {
+	r.mu.Lock()
+	pubsub := r.pubsub
+	r.mu.Unlock()
+
+	if pubsub != nil {
+		pubsub.Close()
+	}
+	return r.client.Close()
+}
+
+func (r *redisBackend) Put(sessionID, field string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	key := r.sessionKey(sessionID)
+	pipe := r.client.TxPipeline()
+	pipe.HSet(ctx, key, field, value)
+	pipe.Expire(ctx, key, redisMetaTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *redisBackend) Delete(sessionID string, fields ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return r.client.HDel(ctx, r.sessionKey(sessionID), fields...).Err()
+}
+
+func (r *redisBackend) Load(sessionID string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	values, err := r.client.HGetAll(ctx, r.sessionKey(sessionID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string][]byte, len(values))
+	for field, value := range values {
+		fields[field] = []byte(value)
+	}
+	return fields, nil
+}
+
+func (r *redisBackend) Drop(sessionID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return r.client.Del(ctx, r.sessionKey(sessionID)).Err()
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 等待事件的最长时间
+const busTestTimeout = 10 * time.Second
+
+// 被测的消息总线后端。nodes为连接到同一总线的两个节点，disconnect断开所有节点与总线服务的连接
+type busFixture struct {
+	nodes      [2]MessageBus
+	meta       SessionMetaStore
+	disconnect func()
+}
+
+// 对内存总线和Redis总线（设置LFT_TEST_REDIS为Redis地址时）分别运行测试
+func forEachBus(t *testing.T, test func(t *testing.T, fixture *busFixture)) {
+	t.Run("memory", func(t *testing.T) {
+		// 进程内只有一个节点，两个节点共用同一个总线；没有连接可以断开
+		bus := newMemoryBus()
+		t.Cleanup(func() { bus.Close() })
+		test(t, &busFixture{
+			nodes:      [2]MessageBus{bus, bus},
+			meta:       newMemoryMetaStore(),
+			disconnect: func() {},
+		})
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		addr := os.Getenv("LFT_TEST_REDIS")
+		if addr == "" {
+			t.Skip("未设置LFT_TEST_REDIS，跳过Redis测试")
+		}
+
+		// 节点通过代理连接Redis，关闭代理上的连接以模拟网络中断
+		proxy := newTCPProxy(t, addr)
+		prefix := fmt.Sprintf("lft-test-%s:", generateUUID()[:8])
+		var fixture busFixture
+		for i := range fixture.nodes {
+			backend, err := newRedisBackend(proxy.addr(), "", 0, prefix)
+			if err != nil {
+				t.Fatalf("连接Redis失败: %v", err)
+			}
+			t.Cleanup(func() { backend.Close() })
+			fixture.nodes[i] = backend
+		}
+		fixture.meta = fixture.nodes[0].(*redisBackend)
+		fixture.disconnect = proxy.dropConnections
+		test(t, &fixture)
+	})
+}
+
+// 收集订阅到的事件
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []busEvent
+	notify chan struct{}
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{notify: make(chan struct{}, 1)}
+}
+
+func (r *eventRecorder) handle(event busEvent) {
+	r.mu.Lock()
+	r.events = append(r.events, event)
+	r.mu.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 等待收到满足条件的事件，返回到目前为止收到的所有事件
+func (r *eventRecorder) waitFor(t *testing.T, done func([]busEvent) bool) []busEvent {
+	t.Helper()
+
+	deadline := time.After(busTestTimeout)
+	for {
+		r.mu.Lock()
+		events := append([]busEvent(nil), r.events...)
+		r.mu.Unlock()
+		if done(events) {
+			return events
+		}
+
+		select {
+		case <-r.notify:
+		case <-deadline:
+			t.Fatalf("等待事件超时，已收到 %d 个事件", len(events))
+		}
+	}
+}
+
+func testEvent(node, sessionID string, seq int) busEvent {
+	return busEvent{
+		Node:      node,
+		SessionID: sessionID,
+		Kind:      busEventMessage,
+		Data:      json.RawMessage(fmt.Sprintf(`{"seq":%d}`, seq)),
+	}
+}
+
+func eventSeq(t *testing.T, event busEvent) int {
+	t.Helper()
+
+	var data struct{ Seq int }
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		t.Fatalf("解析事件数据失败: %v", err)
+	}
+	return data.Seq
+}
+
+func TestBusFanOut(t *testing.T) {
+	forEachBus(t, func(t *testing.T, fixture *busFixture) {
+		// 每个节点两个订阅者，发布者自己也会收到事件
+		var recorders []*eventRecorder
+		for _, node := range fixture.nodes {
+			for i := 0; i < 2; i++ {
+				recorder := newEventRecorder()
+				if err := node.Subscribe(recorder.handle); err != nil {
+					t.Fatalf("订阅失败: %v", err)
+				}
+				recorders = append(recorders, recorder)
+			}
+		}
+
+		const count = 50
+		for seq := 0; seq < count; seq++ {
+			if err := fixture.nodes[seq%2].Publish(testEvent("node-a", "fanout01", seq)); err != nil {
+				t.Fatalf("发布失败: %v", err)
+			}
+		}
+
+		for i, recorder := range recorders {
+			events := recorder.waitFor(t, func(events []busEvent) bool { return len(events) >= count })
+			if len(events) != count {
+				t.Fatalf("订阅者 %d 收到 %d 个事件，期望 %d 个", i, len(events), count)
+			}
+			// 同一节点发布的事件按发布顺序到达
+			last := [2]int{-1, -1}
+			for _, event := range events {
+				if event.Node != "node-a" || event.SessionID != "fanout01" || event.Kind != busEventMessage {
+					t.Fatalf("订阅者 %d 收到的事件不完整: %+v", i, event)
+				}
+				seq := eventSeq(t, event)
+				if seq <= last[seq%2] {
+					t.Fatalf("订阅者 %d 收到的事件顺序错误: %d 在 %d 之后", i, seq, last[seq%2])
+				}
+				last[seq%2] = seq
+			}
+		}
+	})
+}
+
+func TestBusReconnect(t *testing.T) {
+	forEachBus(t, func(t *testing.T, fixture *busFixture) {
+		recorder := newEventRecorder()
+		if err := fixture.nodes[1].Subscribe(recorder.handle); err != nil {
+			t.Fatalf("订阅失败: %v", err)
+		}
+
+		if err := fixture.nodes[0].Publish(testEvent("node-a", "reconn01", 0)); err != nil {
+			t.Fatalf("发布失败: %v", err)
+		}
+		recorder.waitFor(t, func(events []busEvent) bool { return len(events) >= 1 })
+
+		fixture.disconnect()
+
+		// 断开期间发布的事件可能丢失（发布/订阅不保证送达），重新订阅后发布的事件必须到达
+		seq := 1
+		deadline := time.Now().Add(busTestTimeout)
+		received := func(events []busEvent) bool {
+			return len(events) > 0 && eventSeq(t, events[len(events)-1]) >= 1
+		}
+		for {
+			fixture.nodes[0].Publish(testEvent("node-a", "reconn01", seq))
+			seq++
+
+			recorder.mu.Lock()
+			done := received(recorder.events)
+			recorder.mu.Unlock()
+			if done {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("断开连接后没有恢复订阅")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		// 恢复后不再丢失事件
+		final := seq + 100
+		if err := fixture.nodes[0].Publish(testEvent("node-a", "reconn01", final)); err != nil {
+			t.Fatalf("恢复后发布失败: %v", err)
+		}
+		recorder.waitFor(t, func(events []busEvent) bool {
+			return eventSeq(t, events[len(events)-1]) == final
+		})
+	})
+}
+
+func TestSessionMetaStore(t *testing.T) {
+	forEachBus(t, func(t *testing.T, fixture *busFixture) {
+		meta := fixture.meta
+		sessionID := "meta" + generateUUID()[:8]
+		t.Cleanup(func() { meta.Drop(sessionID) })
+
+		if err := meta.Put(sessionID, "text", []byte("你好")); err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+		if err := meta.Put(sessionID, "file:a.txt", []byte(`{"name":"a.txt"}`)); err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+		fields, err := meta.Load(sessionID)
+		if err != nil {
+			t.Fatalf("加载失败: %v", err)
+		}
+		if len(fields) != 2 || string(fields["text"]) != "你好" || string(fields["file:a.txt"]) != `{"name":"a.txt"}` {
+			t.Fatalf("加载的元数据不一致: %q", fields)
+		}
+
+		if err := meta.Delete(sessionID, "file:a.txt"); err != nil {
+			t.Fatalf("删除失败: %v", err)
+		}
+		if fields, _ = meta.Load(sessionID); len(fields) != 1 {
+			t.Fatalf("删除字段后仍有 %d 个字段", len(fields))
+		}
+
+		if err := meta.Drop(sessionID); err != nil {
+			t.Fatalf("删除会话失败: %v", err)
+		}
+		if fields, _ = meta.Load(sessionID); len(fields) != 0 {
+			t.Fatalf("删除会话后仍有 %d 个字段", len(fields))
+		}
+	})
+}
+
+// 发布时阻塞直到放行的消息总线，记录发布的元数据事件
+type gatedBus struct {
+	started chan struct{} // 第一次发布时关闭
+	release chan struct{} // 关闭后放行所有发布
+	once    sync.Once
+
+	mu   sync.Mutex
+	meta []busEvent
+}
+
+func (g *gatedBus) Publish(event busEvent) error {
+	g.once.Do(func() { close(g.started) })
+	<-g.release
+
+	if event.Kind == busEventMeta {
+		g.mu.Lock()
+		g.meta = append(g.meta, event)
+		g.mu.Unlock()
+	}
+	return nil
+}
+
+func (g *gatedBus) Subscribe(handler func(busEvent)) error { return nil }
+func (g *gatedBus) Close() error                           { return nil }
+
+// 发布队列已满时转发的消息可以丢弃，元数据的变化按字段合并后仍然按顺序写入共享存储并发布
+func TestClusterKeepsMetaWhenQueueFull(t *testing.T) {
+	bus := &gatedBus{started: make(chan struct{}), release: make(chan struct{})}
+	meta := newMemoryMetaStore()
+	backend := newClusterBackend("node-a", bus, meta)
+	go backend.run()
+
+	put := func(sessionID, field, value string) busEvent {
+		return busEvent{SessionID: sessionID, Kind: busEventMeta, Field: field, Data: json.RawMessage(value)}
+	}
+	del := func(sessionID, field string) busEvent {
+		return busEvent{SessionID: sessionID, Kind: busEventMeta, Field: field, Deleted: true}
+	}
+
+	// 发布协程阻塞在第一个事件上，之后加入队列的旧值在暂存的新值之前写入
+	backend.enqueue(testEvent("node-a", "meta0001", 0))
+	<-bus.started
+	backend.enqueue(put("meta0001", "c", `"old"`))
+	for seq := 1; seq < busQueueSize; seq++ {
+		backend.enqueue(testEvent("node-a", "meta0001", seq))
+	}
+	backend.enqueue(testEvent("node-a", "meta0001", busQueueSize)) // 丢弃
+
+	for _, event := range []busEvent{
+		put("meta0001", "a", `"1"`),
+		put("meta0001", "b", `"1"`),
+		put("meta0001", "c", `"new"`),
+		put("meta0001", "a", `"2"`),
+		del("meta0001", "b"),
+		put("meta0002", "x", `"1"`),
+		{SessionID: "meta0002", Kind: busEventMeta, Deleted: true},
+		put("meta0002", "y", `"1"`),
+	} {
+		backend.enqueue(event)
+	}
+
+	close(bus.release)
+	backend.close()
+
+	for sessionID, want := range map[string]map[string]string{
+		"meta0001": {"a": `"2"`, "c": `"new"`},
+		"meta0002": {"y": `"1"`},
+	} {
+		fields, _ := meta.Load(sessionID)
+		if len(fields) != len(want) {
+			t.Fatalf("会话 %s 的元数据为 %q，期望 %q", sessionID, fields, want)
+		}
+		for field, value := range want {
+			if string(fields[field]) != value {
+				t.Fatalf("会话 %s 的字段 %s 为 %s，期望 %s", sessionID, field, fields[field], value)
+			}
+		}
+	}
+
+	// 其他节点按同样的顺序收到合并后的变化
+	var published []string
+	for _, event := range bus.meta {
+		published = append(published, fmt.Sprintf("%s/%s=%s,%v", event.SessionID, event.Field, string(event.Data), event.Deleted))
+	}
+	want := []string{
+		`meta0001/c="old",false`,
+		`meta0001/c="new",false`,
+		`meta0001/a="2",false`,
+		`meta0001/b=,true`,
+		`meta0002/=,true`,
+		`meta0002/y="1",false`,
+	}
+	if fmt.Sprint(published) != fmt.Sprint(want) {
+		t.Fatalf("发布的元数据事件为 %v，期望 %v", published, want)
+	}
+}
+
+// 转发到目标地址的TCP代理，可以断开所有已建立的连接
+type tcpProxy struct {
+	listener net.Listener
+	target   string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTCPProxy(t *testing.T, target string) *tcpProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("启动代理失败: %v", err)
+	}
+	proxy := &tcpProxy{listener: listener, target: target}
+	t.Cleanup(func() {
+		listener.Close()
+		proxy.dropConnections()
+	})
+	go proxy.serve()
+	return proxy
+}
+
+func (p *tcpProxy) addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *tcpProxy) serve() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+
+		p.mu.Lock()
+		p.conns = append(p.conns, client, server)
+		p.mu.Unlock()
+
+		go func() {
+			io.Copy(server, client)
+			server.Close()
+		}()
+		go func() {
+			io.Copy(client, server)
+			client.Close()
+		}()
+	}
+}
+
+func (p *tcpProxy) dropConnections() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 支持的分片摘要算法
+const (
+	HashAlgorithmMD5    = "md5"
+	HashAlgorithmSHA256 = "sha256"
+	HashAlgorithmCRC32C = "crc32c"
+)
+
+// 客户端未提供摘要时服务端记录分片哈希使用的算法
+const defaultChunkHashAlgorithm = HashAlgorithmSHA256
+
+// 分片摘要请求头，格式为 "算法=十六进制摘要"，例如 "sha256=9f86d0..." 或 "crc32c=e3069283"
+const chunkDigestHeader = "X-Chunk-Digest"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 根据算法名创建哈希计算器，空算法名按早期版本的MD5处理
+func newChunkHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashAlgorithmMD5, "":
+		return md5.New(), nil
+	case HashAlgorithmSHA256:
+		return sha256.New(), nil
+	case HashAlgorithmCRC32C:
+		return crc32.New(crc32cTable), nil
+	default:
+		return nil, fmt.Errorf("不支持的摘要算法: %s", algorithm)
+	}
+}
+
+// 解析 "算法=摘要" 格式的分片摘要
+func parseChunkDigest(value string) (string, string, error) {
+	algorithm, digest, found := strings.Cut(strings.TrimSpace(value), "=")
+	if !found || digest == "" {
+		return "", "", fmt.Errorf("分片摘要格式无效: %s", value)
+	}
+
+	algorithm = strings.ToLower(strings.ReplaceAll(algorithm, "-", ""))
+	if _, err := newChunkHasher(algorithm); err != nil || algorithm == "" {
+		return "", "", fmt.Errorf("不支持的摘要算法: %s", algorithm)
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", "", fmt.Errorf("分片摘要不是有效的十六进制: %s", digest)
+	}
+	return algorithm, strings.ToLower(digest), nil
+}
+
+// 从请求头或表单字段中读取客户端提供的分片摘要，未提供时返回默认算法和空摘要。
+// field为表单字段或查询参数chunkDigest的值，分片上传以流的方式读取请求体，不能再通过PostForm读取
+func chunkDigestFromRequest(c *gin.Context, field string) (string, string, error) {
+	value := c.GetHeader(chunkDigestHeader)
+	if value == "" {
+		value = field
+	}
+	if value == "" {
+		return defaultChunkHashAlgorithm, "", nil
+	}
+	return parseChunkDigest(value)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseChunkDigest(t *testing.T) {
+	for _, test := range []struct {
+		value     string
+		algorithm string
+		digest    string // 为空表示期望返回错误
+	}{
+		{"sha256=9F86D081", HashAlgorithmSHA256, "9f86d081"},
+		{"SHA-256=9f86d081", HashAlgorithmSHA256, "9f86d081"},
+		{"  md5=900150983cd24fb0d6963f7d28e17f72 ", HashAlgorithmMD5, "900150983cd24fb0d6963f7d28e17f72"},
+		{"crc32c=e3069283", HashAlgorithmCRC32C, "e3069283"},
+		{"CRC-32C=E3069283", HashAlgorithmCRC32C, "e3069283"},
+		{"", "", ""},
+		{"sha256", "", ""},
+		{"sha256=", "", ""},
+		{"=9f86d081", "", ""},
+		{"sha1=9f86d081", "", ""},
+		{"sha256=xyz", "", ""},
+		{"sha256=abc", "", ""}, // 奇数位十六进制
+	} {
+		algorithm, digest, err := parseChunkDigest(test.value)
+		if test.digest == "" {
+			if err == nil {
+				t.Errorf("parseChunkDigest(%q) = %q, %q，期望返回错误", test.value, algorithm, digest)
+			}
+			continue
+		}
+		if err != nil || algorithm != test.algorithm || digest != test.digest {
+			t.Errorf("parseChunkDigest(%q) = %q, %q, %v，期望 %q, %q", test.value, algorithm, digest, err, test.algorithm, test.digest)
+		}
+	}
+}
+
+func TestNewChunkHasher(t *testing.T) {
+	for _, test := range []struct {
+		algorithm string
+		input     string
+		digest    string
+	}{
+		{HashAlgorithmSHA256, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{HashAlgorithmMD5, "abc", "900150983cd24fb0d6963f7d28e17f72"},
+		{"", "abc", "900150983cd24fb0d6963f7d28e17f72"}, // 早期版本的记录没有算法名
+		{HashAlgorithmCRC32C, "123456789", "e3069283"},
+	} {
+		hasher, err := newChunkHasher(test.algorithm)
+		if err != nil {
+			t.Fatalf("newChunkHasher(%q) 失败: %v", test.algorithm, err)
+		}
+		hasher.Write([]byte(test.input))
+		if digest := hex.EncodeToString(hasher.Sum(nil)); digest != test.digest {
+			t.Errorf("%q 算法计算 %q 的摘要为 %s，期望 %s", test.algorithm, test.input, digest, test.digest)
+		}
+	}
+
+	if _, err := newChunkHasher("sha1"); err == nil {
+		t.Error("不支持的算法没有返回错误")
+	}
+}
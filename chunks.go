@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// 服务端建议分片大小时，每个上传的目标分片数。文件较大时按2的倍数增大分片，直到分片数不超过此值或达到分片大小上限
+const targetChunksPerUpload = 1024
+
+// 分片完成状态位图，第i位表示第i个分片是否已完成。JSON中编码为base64字符串
+type chunkBitmap []byte
+
+func newChunkBitmap(totalChunks int) chunkBitmap {
+	return make(chunkBitmap, (totalChunks+7)/8)
+}
+
+func (b chunkBitmap) has(i int) bool {
+	return i >= 0 && i/8 < len(b) && b[i/8]&(1<<(i%8)) != 0
+}
+
+func (b chunkBitmap) set(i int) {
+	b[i/8] |= 1 << (i % 8)
+}
+
+func (b chunkBitmap) clear(i int) {
+	b[i/8] &^= 1 << (i % 8)
+}
+
+// 已完成的分片数
+func (b chunkBitmap) count() int {
+	n := 0
+	for _, v := range b {
+		n += bits.OnesCount8(v)
+	}
+	return n
+}
+
+// 第一个未完成的分片索引，所有分片都已完成时返回total。按字节跳过已完成的分片
+func (b chunkBitmap) firstMissing(total int) int {
+	i := 0
+	for i/8 < len(b) && b[i/8] == 0xff {
+		i += 8
+	}
+	for i < total && b.has(i) {
+		i++
+	}
+	if i > total {
+		return total
+	}
+	return i
+}
+
+// 根据文件大小和客户端建议的分片大小决定上传使用的分片大小。
+// 客户端建议的大小限制在服务端配置的范围内；未建议时从默认分片大小开始，大文件按2的倍数增大分片以控制分片数
+func (e *TransferEngine) chunkSizeFor(fileSize, proposed int64) int64 {
+	if proposed > 0 {
+		if proposed < e.MinChunkSize {
+			return e.MinChunkSize
+		}
+		if proposed > e.MaxChunkSize {
+			return e.MaxChunkSize
+		}
+		return proposed
+	}
+
+	size := e.ChunkSize
+	for size < e.MaxChunkSize && fileSize > size*targetChunksPerUpload {
+		size *= 2
+	}
+	if size > e.MaxChunkSize {
+		size = e.MaxChunkSize
+	}
+	return size
+}
+
+// 第i个分片在文件中的偏移和大小，最后一个分片可能小于分片大小
+func (config *ResumableFileConfig) chunkRange(i int) (offset, size int64) {
+	offset = int64(i) * config.ChunkSize
+	size = config.ChunkSize
+	if remaining := config.FileSize - offset; remaining < size {
+		size = remaining
+	}
+	return offset, size
+}
+
+func (config *ResumableFileConfig) chunkCompleted(i int) bool {
+	return config.Completed.has(i)
+}
+
+// 第i个分片记录的哈希算法和哈希，未完成的分片返回空
+func (config *ResumableFileConfig) chunkHash(i int) (algorithm, hash string) {
+	if i >= len(config.ChunkHashes) {
+		return "", ""
+	}
+	algorithm, hash, _ = strings.Cut(config.ChunkHashes[i], "=")
+	return algorithm, hash
+}
+
+// 标记分片完成并记录哈希
+func (config *ResumableFileConfig) completeChunk(i int, algorithm, hash string) {
+	config.Completed.set(i)
+	config.ChunkHashes[i] = algorithm + "=" + hash
+}
+
+// 标记分片未完成，需要重新上传
+func (config *ResumableFileConfig) resetChunk(i int) {
+	config.Completed.clear(i)
+	config.ChunkHashes[i] = ""
+}
+
+// 已完成的分片数
+func (config *ResumableFileConfig) completedChunks() int {
+	return config.Completed.count()
+}
+
+// 已完成分片的总字节数（不要求连续）
+func (config *ResumableFileConfig) completedBytes() int64 {
+	if config.TotalChunks == 0 {
+		return 0
+	}
+	received := int64(config.completedChunks()) * config.ChunkSize
+	if last := config.TotalChunks - 1; config.chunkCompleted(last) {
+		// 最后一个分片可能小于分片大小
+		_, size := config.chunkRange(last)
+		received -= config.ChunkSize - size
+	}
+	return received
+}
+
+// 从第一个分片开始连续完成的字节数
+func (config *ResumableFileConfig) contiguousBytes() int64 {
+	first := config.Completed.firstMissing(config.TotalChunks)
+	if first == config.TotalChunks {
+		return config.FileSize
+	}
+	offset, _ := config.chunkRange(first)
+	return offset
+}
+
+// 补全加载的配置：早期版本的配置把每个分片记录为一个ChunkInfo对象，转换为位图和哈希列表
+func (config *ResumableFileConfig) normalizeChunks() {
+	if config.Completed == nil {
+		config.Completed = newChunkBitmap(config.TotalChunks)
+		config.ChunkHashes = make([]string, config.TotalChunks)
+		for key, chunk := range config.Chunks {
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= config.TotalChunks || !chunk.Completed {
+				continue
+			}
+			algorithm := chunk.HashAlgorithm
+			if algorithm == "" {
+				algorithm = HashAlgorithmMD5
+			}
+			config.completeChunk(i, algorithm, chunk.Hash)
+		}
+		if len(config.Chunks) > 0 {
+			log.Printf("已将文件 %s 的上传配置转换为分片位图", config.FileName)
+		}
+		config.Chunks = nil
+	}
+
+	if len(config.Completed) < (config.TotalChunks+7)/8 {
+		completed := newChunkBitmap(config.TotalChunks)
+		copy(completed, config.Completed)
+		config.Completed = completed
+	}
+	if len(config.ChunkHashes) < config.TotalChunks {
+		hashes := make([]string, config.TotalChunks)
+		copy(hashes, config.ChunkHashes)
+		config.ChunkHashes = hashes
+	}
+}
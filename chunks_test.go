@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestChunkBitmap(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		total        int
+		set          []int
+		clear        []int
+		count        int
+		firstMissing int
+	}{
+		{"empty", 0, nil, nil, 0, 0},
+		{"none completed", 10, nil, nil, 0, 0},
+		{"first missing after prefix", 10, []int{0, 1, 2, 5}, nil, 4, 3},
+		{"all completed", 10, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, nil, 10, 10},
+		{"full bytes skipped", 20, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 17}, nil, 17, 16},
+		{"exact byte boundary", 16, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, nil, 16, 16},
+		{"cleared chunk missing again", 9, []int{0, 1, 2, 3, 4, 5, 6, 7, 8}, []int{8}, 8, 8},
+		{"cleared in middle", 9, []int{0, 1, 2, 3}, []int{1}, 3, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b := newChunkBitmap(test.total)
+			if len(b) != (test.total+7)/8 {
+				t.Fatalf("%d 个分片的位图长度为 %d", test.total, len(b))
+			}
+			for _, i := range test.set {
+				b.set(i)
+			}
+			for _, i := range test.clear {
+				b.clear(i)
+			}
+
+			if got := b.count(); got != test.count {
+				t.Fatalf("完成分片数为 %d，期望 %d", got, test.count)
+			}
+			if got := b.firstMissing(test.total); got != test.firstMissing {
+				t.Fatalf("第一个未完成的分片为 %d，期望 %d", got, test.firstMissing)
+			}
+
+			completed := make(map[int]bool)
+			for _, i := range test.set {
+				completed[i] = true
+			}
+			for _, i := range test.clear {
+				completed[i] = false
+			}
+			for i := -1; i <= test.total+8; i++ {
+				if b.has(i) != completed[i] {
+					t.Fatalf("分片 %d 的完成状态为 %v", i, b.has(i))
+				}
+			}
+		})
+	}
+}
+
+// 位图在JSON中编码为base64字符串
+func TestChunkBitmapJSON(t *testing.T) {
+	b := newChunkBitmap(12)
+	b.set(0)
+	b.set(9)
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `"AQI="` {
+		t.Fatalf("位图编码为 %s", data)
+	}
+
+	var decoded chunkBitmap
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.has(0) || !decoded.has(9) || decoded.count() != 2 {
+		t.Fatalf("解码后的位图为 %08b", decoded)
+	}
+}
+
+func TestChunkSizeFor(t *testing.T) {
+	const mb = 1 << 20
+	e := &TransferEngine{ChunkSize: 5 * mb, MinChunkSize: 1 * mb, MaxChunkSize: 256 * mb}
+
+	for _, test := range []struct {
+		fileSize int64
+		proposed int64
+		want     int64
+	}{
+		{0, 0, 5 * mb},
+		{100 * mb, 0, 5 * mb},
+		{5 * mb * targetChunksPerUpload, 0, 5 * mb},
+		{5*mb*targetChunksPerUpload + 1, 0, 10 * mb},
+		{100 * 1024 * mb, 0, 160 * mb},
+		{1 << 50, 0, 256 * mb}, // 不超过上限
+		{100 * mb, 2 * mb, 2 * mb},
+		{100 * mb, 3*mb + 1, 3*mb + 1},
+		{100 * mb, 1024, 1 * mb},
+		{100 * mb, 1024 * mb, 256 * mb},
+	} {
+		if got := e.chunkSizeFor(test.fileSize, test.proposed); got != test.want {
+			t.Errorf("chunkSizeFor(%d, %d) = %d，期望 %d", test.fileSize, test.proposed, got, test.want)
+		}
+	}
+}
+
+func TestChunkByteCounts(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		fileSize   int64
+		chunkSize  int64
+		completed  []int
+		received   int64
+		contiguous int64
+	}{
+		{"none", 25, 10, nil, 0, 0},
+		{"prefix", 25, 10, []int{0}, 10, 10},
+		{"gap", 25, 10, []int{0, 2}, 15, 10},
+		{"last only", 25, 10, []int{2}, 5, 0},
+		{"all", 25, 10, []int{0, 1, 2}, 25, 25},
+		{"exact multiple", 30, 10, []int{0, 1, 2}, 30, 30},
+		{"empty file", 0, 10, nil, 0, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			totalChunks := int((test.fileSize + test.chunkSize - 1) / test.chunkSize)
+			config := &ResumableFileConfig{
+				FileSize:    test.fileSize,
+				ChunkSize:   test.chunkSize,
+				TotalChunks: totalChunks,
+				Completed:   newChunkBitmap(totalChunks),
+				ChunkHashes: make([]string, totalChunks),
+			}
+			for _, i := range test.completed {
+				config.completeChunk(i, HashAlgorithmSHA256, testChunkHash(i))
+			}
+
+			if got := config.completedBytes(); got != test.received {
+				t.Fatalf("已完成字节数为 %d，期望 %d", got, test.received)
+			}
+			if got := config.contiguousBytes(); got != test.contiguous {
+				t.Fatalf("连续完成字节数为 %d，期望 %d", got, test.contiguous)
+			}
+		})
+	}
+}
+
+// 早期版本按分片记录的配置转换为位图和哈希列表
+func TestNormalizeLegacyChunks(t *testing.T) {
+	var config ResumableFileConfig
+	if err := json.Unmarshal([]byte(`{
+		"fileName": "a.bin",
+		"fileSize": 40,
+		"chunkSize": 10,
+		"totalChunks": 4,
+		"chunks": {
+			"0": {"completed": true, "hash": "aa"},
+			"2": {"completed": true, "hash": "cc", "hashAlgorithm": "sha256"},
+			"3": {"completed": false, "hash": "dd"},
+			"9": {"completed": true, "hash": "ff"},
+			"x": {"completed": true, "hash": "ee"}
+		}
+	}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	config.normalizeChunks()
+
+	if config.Chunks != nil {
+		t.Fatal("转换后仍保留旧的分片记录")
+	}
+	for i, want := range []string{"md5=aa", "", "sha256=cc", ""} {
+		algorithm, hash := config.chunkHash(i)
+		got := ""
+		if hash != "" {
+			got = algorithm + "=" + hash
+		}
+		if got != want || config.chunkCompleted(i) != (want != "") {
+			t.Fatalf("分片 %d 为 %q（完成: %v），期望 %q", i, got, config.chunkCompleted(i), want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 命令行友好的接口，可以直接用curl上传和下载文件、追加和读取文字，响应为纯文本：
+//
+//	curl -T build.tar.gz http://host/s/<会话ID>/build.tar.gz   上传，返回下载链接
+//	curl http://host/s/<会话ID>/                                 列出会话中的文件
+//	curl -O http://host/s/<会话ID>/build.tar.gz                  下载
+//	echo 构建完成 | curl --data-binary @- http://host/t/<会话ID>  追加文字
+//	curl http://host/t/<会话ID>                                  读取文字
+
+// 会话文字内容的最大长度。追加后超过此长度时从开头按行丢弃较早的内容
+const maxTextContentSize = 1 << 20
+
+// 返回纯文本的错误响应
+func respondPlainError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	if transferErr, ok := err.(*TransferError); ok {
+		status = transferErr.Status
+	}
+	c.String(status, "错误: %s\n", err.Error())
+}
+
+// 文件的下载链接
+func plainDownloadURL(c *gin.Context, sessionID, fileName string) string {
+	return externalBaseURL(c) + "/s/" + sessionID + "/" + url.PathEscape(fileName)
+}
+
+// 通过PUT请求体上传文件：数据边接收边按分片写入存储，完成后加入会话的已接收文件列表并通知浏览器，响应体为下载链接。
+// 请求头X-File-Hash可以提供文件的SHA-256哈希，服务器上已有相同内容时直接秒传，中断后重新上传同一文件时从断点继续
+func putSessionFile(c *gin.Context) {
+	// 跟踪进行中的写入，服务关闭时等待其完成
+	if !uploadWrites.begin() {
+		c.Header("Retry-After", strconv.Itoa(int(serverConfig.ReconnectDelay.Seconds())))
+		c.String(http.StatusServiceUnavailable, "错误: 服务器正在关闭，请稍后重试\n")
+		return
+	}
+	defer uploadWrites.end()
+
+	sessionID := c.Param("sessionID")
+	fileName, err := normalizeUploadTarget(sessionID, c.Param("filename"))
+	if err != nil {
+		respondPlainError(c, newTransferError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.RLock()
+	clientID := requestClientID(c, session)
+	session.mu.RUnlock()
+
+	// 没有Content-Length（例如 curl -T - 从标准输入上传）时先把请求体写入临时文件以确定大小
+	body, size := io.Reader(c.Request.Body), c.Request.ContentLength
+	if size < 0 {
+		spool, err := spoolRequestBody(c.Request.Body)
+		if err != nil {
+			respondPlainError(c, err)
+			return
+		}
+		defer func() {
+			spool.Close()
+			os.Remove(spool.Name())
+		}()
+		info, err := spool.Stat()
+		if err != nil {
+			respondPlainError(c, err)
+			return
+		}
+		body, size = spool, info.Size()
+	}
+
+	fileHash := c.GetHeader("X-File-Hash")
+	start, err := transfers.Receive(UploadStartRequest{
+		SessionID: sessionID,
+		FileName:  fileName,
+		FileSize:  size,
+		FileHash:  fileHash,
+		ClientID:  clientID,
+	}, body)
+	if err != nil {
+		log.Printf("PUT上传文件 %s 失败: %v", fileName, err)
+		// 请求体不完整或客户端中断。没有文件哈希的上传无法从断点继续，删除这次上传的数据并通知浏览器；
+		// 提供了哈希时保留已写入的分片，重新上传同一文件时继续
+		if start != nil && fileHash == "" {
+			if err := transfers.Cancel(sessionID, fileName, clientID); err != nil {
+				log.Printf("删除中断的上传 %s 失败: %v", fileName, err)
+			}
+		}
+		respondPlainError(c, err)
+		return
+	}
+	if start.Existing != nil {
+		respondPlainError(c, newTransferError(http.StatusConflict, "会话中已存在同名文件"))
+		return
+	}
+	if !start.Completed {
+		// PUT上传无法单独重传校验失败的分片，删除这次上传的数据
+		if err := transfers.Cancel(sessionID, fileName, clientID); err != nil {
+			log.Printf("删除校验失败的上传 %s 失败: %v", fileName, err)
+		}
+		respondPlainError(c, newTransferError(http.StatusConflict, "文件完整性验证失败，请重新上传"))
+		return
+	}
+
+	log.Printf("PUT上传文件完成: %s/%s (%d 字节)", sessionID, fileName, size)
+	c.String(http.StatusCreated, "%s\n", plainDownloadURL(c, sessionID, fileName))
+}
+
+// 把长度未知的请求体写入临时文件，超过最大文件大小时返回错误
+func spoolRequestBody(r io.Reader) (*os.File, error) {
+	spool, err := os.CreateTemp(TempDir, "put-*.tmp")
+	if err != nil {
+		log.Printf("创建临时文件失败: %v", err)
+		return nil, newTransferError(http.StatusInternalServerError, "创建临时文件失败")
+	}
+
+	written, err := io.Copy(spool, io.LimitReader(r, MaxFileSize+1))
+	if err == nil && written > MaxFileSize {
+		err = newTransferError(http.StatusRequestEntityTooLarge, "文件大小无效")
+	}
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		var transferErr *TransferError
+		if !errors.As(err, &transferErr) {
+			err = newTransferError(http.StatusBadRequest, "读取请求体失败")
+		}
+		return nil, err
+	}
+	return spool, nil
+}
+
+// 以纯文本列出会话中的文件，每行为 "文件名<Tab>大小<Tab>下载链接"。定向传输的文件只对接收方和上传者列出
+func listSessionFilesPlain(c *gin.Context) {
+	sessionID := c.Param("sessionID")
+
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.RLock()
+	clientID := requestClientID(c, session)
+	files := make([]*FileInfo, 0, len(session.ReceivedFiles))
+	for _, fileInfo := range session.ReceivedFiles {
+		if fileInfo.accessibleBy(clientID) {
+			files = append(files, fileInfo.snapshot())
+		}
+	}
+	session.mu.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	var b strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&b, "%s\t%d\t%s\n", file.Name, file.Size, plainDownloadURL(c, sessionID, file.Name))
+	}
+	c.String(http.StatusOK, b.String())
+}
+
+// 会话文字内容的JSON表示
+type textResponse struct {
+	SessionID string      `json:"sessionID"`
+	Content   string      `json:"content"`
+	Author    *ClientInfo `json:"author,omitempty"`
+}
+
+// 把请求体作为一条消息追加到会话文字内容，并像浏览器中的修改一样以text消息广播给会话中的客户端。
+// 作者为通过clientID和clientKey识别的客户端，匿名请求可以通过nickname查询参数指定显示的昵称
+func appendSessionText(c *gin.Context) {
+	sessionID := c.Param("sessionID")
+
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxTextContentSize+1))
+	if err != nil {
+		respondPlainError(c, newTransferError(http.StatusBadRequest, "读取请求体失败"))
+		return
+	}
+	if len(data) > maxTextContentSize {
+		respondPlainError(c, newTransferError(http.StatusRequestEntityTooLarge, "文字内容过长"))
+		return
+	}
+	if !utf8.Valid(data) {
+		respondPlainError(c, newTransferError(http.StatusBadRequest, "文字内容不是有效的UTF-8"))
+		return
+	}
+	text := string(data)
+	if text == "" {
+		respondPlainError(c, newTransferError(http.StatusBadRequest, "文字内容为空"))
+		return
+	}
+
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	author := &ClientInfo{
+		Nickname: sanitizeNickname(c.Query("nickname")),
+		Device:   detectDevice(c.Request.UserAgent()),
+		JoinedAt: time.Now(),
+	}
+	if clientID := requestClientID(c, session); clientID != "" {
+		if info, ok := session.clientInfo(clientID); ok {
+			author = &info
+		} else {
+			author.ID = clientID
+		}
+	}
+	if author.Nickname == "" {
+		author.Nickname = "命令行"
+	}
+
+	session.publishText(appendText(session.TextContent, text), author, nil)
+	log.Printf("会话 %s 追加文字 %d 字节", sessionID, len(text))
+	c.Status(http.StatusNoContent)
+}
+
+// 在已有文字后追加一条消息，消息之间换行分隔，超过最大长度时按行丢弃开头较早的内容
+func appendText(content, text string) string {
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	content += text
+	if len(content) <= maxTextContentSize {
+		return content
+	}
+
+	content = content[len(content)-maxTextContentSize:]
+	if i := strings.IndexByte(content, '\n'); i >= 0 && i < len(content)-1 {
+		return content[i+1:]
+	}
+	// 没有换行时从有效的UTF-8字符边界开始
+	for len(content) > 0 && !utf8.RuneStart(content[0]) {
+		content = content[1:]
+	}
+	return content
+}
+
+// 读取会话文字内容：请求头Accept为application/json时返回JSON（包含最后修改的作者），否则返回纯文本
+func getSessionText(c *gin.Context) {
+	sessionID := c.Param("sessionID")
+
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.RLock()
+	response := textResponse{
+		SessionID: sessionID,
+		Content:   session.TextContent,
+		Author:    session.TextAuthor,
+	}
+	session.mu.RUnlock()
+
+	switch c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) {
+	case gin.MIMEJSON:
+		c.JSON(http.StatusOK, response)
+	default:
+		c.String(http.StatusOK, response.Content)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestAppendText(t *testing.T) {
+	// 比最大长度多出一行的内容
+	lines := strings.Repeat(strings.Repeat("a", 99)+"\n", maxTextContentSize/100+1)
+
+	for _, test := range []struct {
+		name    string
+		content string
+		text    string
+		want    string
+	}{
+		{"empty content", "", "hello", "hello"},
+		{"separated by newline", "first", "second", "first\nsecond"},
+		{"existing trailing newline", "first\n", "second", "first\nsecond"},
+		{"text with trailing newline", "first", "second\n", "first\nsecond\n"},
+		// 超过最大长度时从换行处丢弃开头的内容
+		{"drop leading lines", lines, "tail", lines[100:] + "tail"},
+		// 只有追加内容末尾有换行时不在换行处截断
+		{"single long line", "old", strings.Repeat("b", maxTextContentSize-1) + "\n", strings.Repeat("b", maxTextContentSize-1) + "\n"},
+		// 没有换行时从UTF-8字符边界开始
+		{"rune boundary", "", "a" + strings.Repeat("文", maxTextContentSize/3+1), strings.Repeat("文", maxTextContentSize/3)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := appendText(test.content, test.text)
+			if len(got) > maxTextContentSize || !utf8.ValidString(got) {
+				t.Fatalf("追加后的文字长度为 %d，UTF-8有效: %v", len(got), utf8.ValidString(got))
+			}
+			if got != test.want {
+				t.Fatalf("追加后的文字长度为 %d，期望 %d", len(got), len(test.want))
+			}
+		})
+	}
+}
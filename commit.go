@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// 上传文件句柄空闲多久后关闭
+const uploadFileIdleTimeout = 30 * time.Second
+
+// 进行中上传的临时文件。同一上传的所有分片共享一个打开的文件句柄，通过WriteAt并发写入各自的位置，互不等待；
+// 只有写入后的提交（同步文件、标记分片完成、追加上传日志）是串行的，并按组进行：
+// 提交期间到达的分片在下一轮一起提交，多个分片只需要一次文件同步和一次日志同步
+type uploadFile struct {
+	sessionID  string
+	fileName   string
+	configPath string
+	createdAt  time.Time // 对应上传的创建时间，上传被重新开始后旧的句柄不再使用
+	file       *os.File
+
+	refs  int         // 正在使用句柄的分片数，由传输引擎的锁保护
+	idle  *time.Timer // 没有分片使用时延迟关闭
+	stale bool        // 已从传输引擎中移除，最后一个使用者释放时关闭
+
+	mu         sync.Mutex
+	pending    []*chunkCommit
+	committing bool
+}
+
+// 等待提交的分片
+type chunkCommit struct {
+	index     int
+	algorithm string
+	hash      string
+
+	result *ChunkResult
+	err    error
+	done   chan struct{}
+}
+
+// 获取上传的共享文件句柄，使用完后需调用releaseUploadFile
+func (e *TransferEngine) acquireUploadFile(sessionID, fileName, configPath string, config *ResumableFileConfig) (*uploadFile, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	f, exists := e.files[configPath]
+	if exists && !f.createdAt.Equal(config.CreatedAt) {
+		e.retireUploadFileLocked(configPath)
+		exists = false
+	}
+	if !exists {
+		file, err := os.OpenFile(config.TempFilePath, os.O_WRONLY, 0644)
+		if err != nil {
+			log.Printf("打开文件失败: %v", err)
+			return nil, newTransferError(http.StatusInternalServerError, "写入分片失败")
+		}
+		f = &uploadFile{
+			sessionID:  sessionID,
+			fileName:   fileName,
+			configPath: configPath,
+			createdAt:  config.CreatedAt,
+			file:       file,
+		}
+		e.files[configPath] = f
+	}
+
+	f.refs++
+	if f.idle != nil {
+		f.idle.Stop()
+		f.idle = nil
+	}
+	return f, nil
+}
+
+// 释放文件句柄。没有分片使用时，已移除的句柄立即关闭，其他句柄空闲一段时间后关闭
+func (e *TransferEngine) releaseUploadFile(f *uploadFile) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	f.refs--
+	if f.refs > 0 {
+		return
+	}
+	if f.stale {
+		f.file.Close()
+		return
+	}
+	f.idle = time.AfterFunc(uploadFileIdleTimeout, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if f.refs == 0 && e.files[f.configPath] == f {
+			e.retireUploadFileLocked(f.configPath)
+		}
+	})
+}
+
+// 从传输引擎中移除上传的文件句柄，传输结束或重新开始时调用。调用方需持有传输引擎的锁
+func (e *TransferEngine) retireUploadFileLocked(configPath string) {
+	f, exists := e.files[configPath]
+	if !exists {
+		return
+	}
+	delete(e.files, configPath)
+	f.stale = true
+	if f.idle != nil {
+		f.idle.Stop()
+		f.idle = nil
+	}
+	if f.refs == 0 {
+		f.file.Close()
+	}
+}
+
+// 提交一个已写入的分片，等待所在的一组分片提交完成后返回结果
+func (e *TransferEngine) commitChunk(f *uploadFile, commit *chunkCommit) (*ChunkResult, error) {
+	commit.done = make(chan struct{})
+
+	f.mu.Lock()
+	f.pending = append(f.pending, commit)
+	if !f.committing {
+		f.committing = true
+		go e.runCommits(f)
+	}
+	f.mu.Unlock()
+
+	<-commit.done
+	return commit.result, commit.err
+}
+
+// 依次提交等待中的分片，直到没有新的分片到达
+func (e *TransferEngine) runCommits(f *uploadFile) {
+	f.mu.Lock()
+	for len(f.pending) > 0 {
+		batch := f.pending
+		f.pending = nil
+		f.mu.Unlock()
+
+		e.commitBatch(f, batch)
+
+		f.mu.Lock()
+	}
+	f.committing = false
+	f.mu.Unlock()
+}
+
+// 提交一组分片：同步一次文件数据，在配置文件锁内标记这些分片完成并一次性追加到上传日志，所有分片完成时完成传输
+func (e *TransferEngine) commitBatch(f *uploadFile, batch []*chunkCommit) {
+	defer func() {
+		for _, commit := range batch {
+			close(commit.done)
+		}
+	}()
+	fail := func(err error) {
+		for _, commit := range batch {
+			commit.err = err
+		}
+	}
+
+	if err := f.file.Sync(); err != nil {
+		log.Printf("同步文件失败: %v", err)
+		fail(newTransferError(http.StatusInternalServerError, "写入分片失败"))
+		return
+	}
+
+	configLock := resumableConfigLock(f.configPath)
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	// 重新加载配置：写入期间上传可能已被取消或重新开始
+	config, err := loadResumableConfig(f.configPath)
+	if err != nil {
+		fail(newTransferError(http.StatusNotFound, "上传配置不存在"))
+		return
+	}
+	if !config.CreatedAt.Equal(f.createdAt) {
+		fail(newTransferError(http.StatusConflict, "上传已被重新开始，请重新上传该分片"))
+		return
+	}
+
+	indexes := make([]int, 0, len(batch))
+	for _, commit := range batch {
+		if !config.chunkCompleted(commit.index) {
+			config.completeChunk(commit.index, commit.algorithm, commit.hash)
+			indexes = append(indexes, commit.index)
+		}
+	}
+
+	var result ChunkResult
+	if len(indexes) > 0 {
+		config.UpdatedAt = time.Now()
+
+		// 追加到上传日志
+		if err := saveChunkState(f.configPath, config, indexes...); err != nil {
+			log.Printf("保存配置文件失败: %v", err)
+			fail(newTransferError(http.StatusInternalServerError, "保存配置文件失败"))
+			return
+		}
+		e.notifyProgress(f.configPath, config)
+		e.recordThroughput(f.configPath, config)
+
+		completed := config.completedChunks()
+		log.Printf("分片 %v 上传完成，总进度: %d/%d", indexes, completed, config.TotalChunks)
+		result.Completed = completed == config.TotalChunks
+	}
+	result.Progress = calculateProgress(config)
+
+	if result.Completed {
+		// 所有分片完成，校验后添加到会话的已接收文件列表
+		failedChunks, err := e.finalize(f.sessionID, f.fileName, f.configPath, config)
+		if err != nil {
+			log.Printf("文件 %s 完成校验失败: %v", f.fileName, err)
+			result.Completed = false
+			result.Progress = calculateProgress(config)
+			result.MissingChunks = failedChunks
+		}
+	}
+
+	for _, commit := range batch {
+		chunkResult := result
+		chunkResult.ChunkIndex = commit.index
+		commit.result = &chunkResult
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+)
+
+// 测试用的传输引擎，分片很小以便一个文件有很多分片
+const testChunkSize = 4096
+
+func newTestEngine() *TransferEngine {
+	return &TransferEngine{
+		ChunkSize:    testChunkSize,
+		MinChunkSize: testChunkSize,
+		MaxChunkSize: testChunkSize,
+		progress:     make(map[string]*transferProgress),
+		stats:        make(map[string]*transferStats),
+		files:        make(map[string]*uploadFile),
+	}
+}
+
+// 开始上传一个随机内容的文件
+func beginTestUpload(t *testing.T, e *TransferEngine, sessionID, fileName string, totalChunks int) ([]byte, *TransferStart) {
+	t.Helper()
+
+	data := make([]byte, (totalChunks-1)*testChunkSize+testChunkSize/3)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	start, err := e.Begin(UploadStartRequest{
+		SessionID: sessionID,
+		FileName:  fileName,
+		FileSize:  int64(len(data)),
+		FileHash:  hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		t.Fatalf("开始上传失败: %v", err)
+	}
+	if start.TotalChunks != totalChunks {
+		t.Fatalf("分片数为 %d，期望 %d", start.TotalChunks, totalChunks)
+	}
+	t.Cleanup(func() {
+		store.mu.Lock()
+		delete(store.sessions, sessionID)
+		store.mu.Unlock()
+		contents.release(storagePath(sessionID, fileName))
+		forgetConfig(start.ConfigPath)
+	})
+	return data, start
+}
+
+func testChunk(data []byte, i int) []byte {
+	end := (i + 1) * testChunkSize
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[i*testChunkSize : end]
+}
+
+// 并发写入同时完成的分片分组提交，所有分片都被记录，重新加载后状态一致，最后一个分片完成传输
+func TestConcurrentChunkCommits(t *testing.T) {
+	useTestStorage(t)
+	e := newTestEngine()
+	const totalChunks = 64
+	data, start := beginTestUpload(t, e, "commit01", "a.bin", totalChunks)
+
+	// 除最后一个分片外全部并发写入，每四个分片中有一个重复写入
+	var wg sync.WaitGroup
+	errs := make(chan error, totalChunks*2)
+	for i := 0; i < totalChunks-1; i++ {
+		copies := 1
+		if i%4 == 3 {
+			copies = 2
+		}
+		for ; copies > 0; copies-- {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				result, err := e.WriteChunk("commit01", "a.bin", i, bytes.NewReader(testChunk(data, i)), defaultChunkHashAlgorithm, "")
+				if err == nil && result.Completed {
+					err = errors.New("还有分片没有写入时传输已完成")
+				}
+				if err != nil {
+					errs <- err
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("写入分片失败: %v", err)
+	}
+
+	// 已提交的分片都已写入日志
+	config := reloadConfig(t, start.ConfigPath)
+	if missing := missingChunks(config); len(missing) != 1 || missing[0] != totalChunks-1 {
+		t.Fatalf("缺失分片为 %v，期望只缺少最后一个分片", missing)
+	}
+	for i := 0; i < totalChunks-1; i++ {
+		sum := sha256.Sum256(testChunk(data, i))
+		if algorithm, hash := config.chunkHash(i); algorithm != HashAlgorithmSHA256 || hash != hex.EncodeToString(sum[:]) {
+			t.Fatalf("分片 %d 记录的哈希为 %s=%s", i, algorithm, hash)
+		}
+	}
+
+	result, err := e.WriteChunk("commit01", "a.bin", totalChunks-1, bytes.NewReader(testChunk(data, totalChunks-1)), defaultChunkHashAlgorithm, "")
+	if err != nil {
+		t.Fatalf("写入最后一个分片失败: %v", err)
+	}
+	if !result.Completed {
+		t.Fatalf("所有分片写入后传输未完成: %+v", result)
+	}
+
+	session := store.GetOrCreateSession("commit01")
+	session.mu.RLock()
+	file, exists := session.ReceivedFiles["a.bin"]
+	session.mu.RUnlock()
+	if !exists {
+		t.Fatal("完成的文件没有加入会话")
+	}
+	stored, err := os.ReadFile(file.TempFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Fatal("保存的文件内容与上传的不一致")
+	}
+	if _, err := os.Stat(start.ConfigPath); !os.IsNotExist(err) {
+		t.Fatalf("完成后上传配置仍然存在: %v", err)
+	}
+}
+
+// 所有分片同时写入时，最后提交的一组分片完成传输，文件加入会话且不再是进行中的上传
+func TestConcurrentFinalChunks(t *testing.T) {
+	useTestStorage(t)
+	e := newTestEngine()
+	const totalChunks = 16
+	data, _ := beginTestUpload(t, e, "commit02", "a.bin", totalChunks)
+
+	var wg sync.WaitGroup
+	results := make(chan *ChunkResult, totalChunks)
+	for i := 0; i < totalChunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, err := e.WriteChunk("commit02", "a.bin", i, bytes.NewReader(testChunk(data, i)), defaultChunkHashAlgorithm, "")
+			if err != nil {
+				t.Errorf("写入分片 %d 失败: %v", i, err)
+				return
+			}
+			results <- result
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	completed := 0
+	for result := range results {
+		if result.Completed {
+			completed++
+		}
+	}
+	if completed == 0 {
+		t.Fatal("没有分片报告传输完成")
+	}
+
+	session := store.GetOrCreateSession("commit02")
+	session.mu.RLock()
+	_, received := session.ReceivedFiles["a.bin"]
+	_, pending := session.PendingUploads["a.bin"]
+	session.mu.RUnlock()
+	if !received || pending {
+		t.Fatalf("完成后文件状态不正确: 已接收 %v, 上传中 %v", received, pending)
+	}
+}
+
+// 写入分片期间上传被取消或重新开始时，提交失败且不会把分片记录到新的上传中
+func TestCommitAfterUploadChanged(t *testing.T) {
+	for name, change := range map[string]struct {
+		apply  func(t *testing.T, configPath string)
+		status int
+	}{
+		"cancelled": {
+			apply: func(t *testing.T, configPath string) {
+				if err := removeResumableConfig(configPath); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status: http.StatusNotFound,
+		},
+		"restarted": {
+			apply: func(t *testing.T, configPath string) {
+				config := reloadConfig(t, configPath)
+				config.CreatedAt = config.CreatedAt.Add(1)
+				if err := saveResumableConfig(configPath, config); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status: http.StatusConflict,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			useTestStorage(t)
+			e := newTestEngine()
+			_, start := beginTestUpload(t, e, "commit03", "a.bin", 4)
+
+			config := reloadConfig(t, start.ConfigPath)
+			f, err := e.acquireUploadFile("commit03", "a.bin", start.ConfigPath, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.releaseUploadFile(f)
+
+			change.apply(t, start.ConfigPath)
+
+			_, err = e.commitChunk(f, &chunkCommit{index: 0, algorithm: HashAlgorithmSHA256, hash: testChunkHash(0)})
+			var transferErr *TransferError
+			if !errors.As(err, &transferErr) || transferErr.Status != change.status {
+				t.Fatalf("提交返回 %v，期望状态码 %d", err, change.status)
+			}
+			if name == "restarted" && reloadConfig(t, start.ConfigPath).chunkCompleted(0) {
+				t.Fatal("旧上传的分片被记录到重新开始的上传中")
+			}
+		})
+	}
+}
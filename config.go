@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version 服务器版本号，通过mDNS的TXT记录对外公布
+const Version = "1.1.0"
+
+// ServerConfig 服务器运行配置
+type ServerConfig struct {
+	Port           int         // 监听端口
+	ExternalHost   string      // 对外访问的主机名（含端口），为空时使用请求中的Host
+	ExternalScheme string      // 对外访问的协议（http/https），为空时根据请求自动判断
+	TrustedProxies addressList // 可信的反向代理地址，只有来自这些地址的请求才使用X-Forwarded-*头
+	TLSCertFile    string      // TLS证书文件，与私钥文件同时设置时启用HTTPS
+	TLSKeyFile     string      // TLS私钥文件
+	MDNSEnabled    bool        // 是否通过mDNS在局域网内广播服务
+	MDNSInstance   string      // mDNS服务实例名，为空时使用主机名
+
+	ShutdownTimeout time.Duration // 优雅关闭时等待进行中写入的最长时间
+	ReconnectDelay  time.Duration // 通知客户端在多久之后重新连接
+
+	ProgressInterval time.Duration // 广播传输进度的间隔，0表示不广播
+
+	PingInterval time.Duration // 向WebSocket客户端发送ping的间隔
+	PongTimeout  time.Duration // 超过此时间没有收到客户端的任何数据（包括pong）则断开连接
+	WriteTimeout time.Duration // 向WebSocket客户端写入一条消息的最长时间
+
+	SendQueueSize int           // 每个WebSocket客户端的发送队列长度，超过后视为积压
+	LagTimeout    time.Duration // 发送队列积压超过此时间仍未恢复则断开连接
+
+	DiskWriters  int      // 后台写入WebSocket上传数据的协程数
+	ChunkSize    byteSize // 默认分片大小，大文件在此基础上按2的倍数增大
+	MinChunkSize byteSize // 客户端可以建议的最小分片大小
+	MaxChunkSize byteSize // 客户端可以建议的最大分片大小，也是服务端建议的上限
+
+	NodeID        string // 集群中的节点ID，为空时自动生成
+	Bus           string // 节点间的消息总线：memory（单节点）或 redis
+	RedisAddr     string // Redis地址
+	RedisPassword string // Redis密码
+	RedisDB       int    // Redis数据库编号
+	RedisPrefix   string // Redis键和频道的前缀
+}
+
+// 是否启用了TLS
+func (c *ServerConfig) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// 全局配置
+var serverConfig = &ServerConfig{
+	Port:            9555,
+	MDNSEnabled:     true,
+	ShutdownTimeout: 30 * time.Second,
+	ReconnectDelay:  10 * time.Second,
+
+	ProgressInterval: time.Second,
+
+	PingInterval: 25 * time.Second,
+	PongTimeout:  60 * time.Second,
+	WriteTimeout: 10 * time.Second,
+
+	SendQueueSize: 1024,
+	LagTimeout:    30 * time.Second,
+
+	DiskWriters:  4,
+	ChunkSize:    ChunkSize,
+	MinChunkSize: 1 << 20,
+	MaxChunkSize: 256 << 20,
+
+	Bus:         "memory",
+	RedisAddr:   "localhost:6379",
+	RedisPrefix: "lft:",
+}
+
+// 解析命令行参数，环境变量作为默认值
+func parseConfig(args []string) error {
+	fs := flag.NewFlagSet("lft", flag.ContinueOnError)
+	fs.IntVar(&serverConfig.Port, "port", serverConfig.Port, "监听端口")
+	fs.StringVar(&serverConfig.ExternalHost, "external-host", os.Getenv("LFT_EXTERNAL_HOST"), "对外访问的主机名，例如 files.example.com")
+	fs.StringVar(&serverConfig.ExternalScheme, "external-scheme", os.Getenv("LFT_EXTERNAL_SCHEME"), "对外访问的协议 (http 或 https)")
+	if value := os.Getenv("LFT_TRUSTED_PROXIES"); value != "" {
+		if err := serverConfig.TrustedProxies.Set(value); err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return err
+		}
+	}
+	fs.Var(&serverConfig.TrustedProxies, "trusted-proxies", "可信的反向代理地址（IP或CIDR，逗号分隔），只有来自这些地址的请求才使用X-Forwarded-Host和X-Forwarded-Proto头")
+	fs.StringVar(&serverConfig.TLSCertFile, "tls-cert", os.Getenv("LFT_TLS_CERT"), "TLS证书文件路径")
+	fs.StringVar(&serverConfig.TLSKeyFile, "tls-key", os.Getenv("LFT_TLS_KEY"), "TLS私钥文件路径")
+	fs.BoolVar(&serverConfig.MDNSEnabled, "mdns", serverConfig.MDNSEnabled, "是否通过mDNS在局域网内广播服务")
+	fs.StringVar(&serverConfig.MDNSInstance, "mdns-name", os.Getenv("LFT_MDNS_NAME"), "mDNS服务实例名，默认使用主机名")
+	fs.DurationVar(&serverConfig.ShutdownTimeout, "shutdown-timeout", serverConfig.ShutdownTimeout, "优雅关闭时等待进行中上传写入的最长时间")
+	fs.DurationVar(&serverConfig.ReconnectDelay, "reconnect-delay", serverConfig.ReconnectDelay, "服务关闭时建议客户端重新连接的等待时间")
+	fs.DurationVar(&serverConfig.ProgressInterval, "progress-interval", serverConfig.ProgressInterval, "向会话成员广播传输进度、速度和剩余时间的间隔，0表示不广播")
+	fs.StringVar(&serverConfig.NodeID, "node-id", os.Getenv("LFT_NODE_ID"), "集群中的节点ID，默认根据主机名生成")
+	fs.StringVar(&serverConfig.Bus, "bus", envOrDefault("LFT_BUS", serverConfig.Bus), "节点间的消息总线 (memory 或 redis)")
+	fs.StringVar(&serverConfig.RedisAddr, "redis-addr", envOrDefault("LFT_REDIS_ADDR", serverConfig.RedisAddr), "Redis地址")
+	fs.StringVar(&serverConfig.RedisPassword, "redis-password", os.Getenv("LFT_REDIS_PASSWORD"), "Redis密码")
+	fs.IntVar(&serverConfig.RedisDB, "redis-db", serverConfig.RedisDB, "Redis数据库编号")
+	fs.StringVar(&serverConfig.RedisPrefix, "redis-prefix", serverConfig.RedisPrefix, "Redis键和频道的前缀，多个部署共用一个Redis时用于区分")
+	fs.DurationVar(&serverConfig.PingInterval, "ws-ping-interval", serverConfig.PingInterval, "向WebSocket客户端发送心跳ping的间隔")
+	fs.DurationVar(&serverConfig.PongTimeout, "ws-pong-timeout", serverConfig.PongTimeout, "超过此时间没有收到客户端的心跳响应则断开连接，必须大于心跳间隔")
+	fs.DurationVar(&serverConfig.WriteTimeout, "ws-write-timeout", serverConfig.WriteTimeout, "向WebSocket客户端写入一条消息的最长时间")
+	fs.IntVar(&serverConfig.SendQueueSize, "ws-send-queue", serverConfig.SendQueueSize, "每个WebSocket客户端的发送队列长度，超过后通知客户端消息积压")
+	fs.DurationVar(&serverConfig.LagTimeout, "ws-lag-timeout", serverConfig.LagTimeout, "发送队列积压超过此时间仍未恢复则断开连接")
+	fs.IntVar(&serverConfig.DiskWriters, "disk-writers", serverConfig.DiskWriters, "后台写入WebSocket上传数据的协程数，同一文件的数据总是由同一个协程按顺序写入")
+	fs.Var(&serverConfig.ChunkSize, "chunk-size", "默认分片大小，例如 5MB、64MB；大文件会按2的倍数增大分片以控制分片数")
+	fs.Var(&serverConfig.MinChunkSize, "min-chunk-size", "客户端可以建议的最小分片大小")
+	fs.Var(&serverConfig.MaxChunkSize, "max-chunk-size", "客户端可以建议的最大分片大小，也是服务端建议的上限；分片以流的方式写入磁盘，不会整个读入内存")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if serverConfig.PingInterval <= 0 || serverConfig.PongTimeout <= serverConfig.PingInterval {
+		err := fmt.Errorf("-ws-pong-timeout (%s) 必须大于 -ws-ping-interval (%s)，且心跳间隔必须大于0", serverConfig.PongTimeout, serverConfig.PingInterval)
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	if serverConfig.MinChunkSize < MinChunkSize || serverConfig.MaxChunkSize > MaxChunkSize {
+		err := fmt.Errorf("-min-chunk-size 和 -max-chunk-size 必须在 %s 到 %s 之间", byteSize(MinChunkSize), byteSize(MaxChunkSize))
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	if serverConfig.ChunkSize < serverConfig.MinChunkSize || serverConfig.ChunkSize > serverConfig.MaxChunkSize {
+		err := fmt.Errorf("-chunk-size 必须在 -min-chunk-size（%s）到 -max-chunk-size（%s）之间", serverConfig.MinChunkSize, serverConfig.MaxChunkSize)
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	if serverConfig.Bus == "redis" && serverConfig.NodeID == "" {
+		// 进行中的上传记录所在的节点，节点ID在重启后必须保持不变才能继续自己的上传
+		err := fmt.Errorf("-bus redis 需要通过 -node-id 指定固定的节点ID")
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	if serverConfig.WriteTimeout <= 0 || serverConfig.SendQueueSize <= 0 || serverConfig.LagTimeout <= 0 {
+		err := fmt.Errorf("-ws-write-timeout、-ws-send-queue 和 -ws-lag-timeout 必须大于0")
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	return nil
+}
+
+// 字节数参数，支持 KB、MB、GB 后缀（按1024换算）
+type byteSize int64
+
+func (b byteSize) String() string {
+	switch {
+	case b >= 1<<30 && b%(1<<30) == 0:
+		return strconv.FormatInt(int64(b>>30), 10) + "GB"
+	case b >= 1<<20 && b%(1<<20) == 0:
+		return strconv.FormatInt(int64(b>>20), 10) + "MB"
+	case b >= 1<<10 && b%(1<<10) == 0:
+		return strconv.FormatInt(int64(b>>10), 10) + "KB"
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("无效的大小: %s", value)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+// 逗号分隔的IP地址和CIDR网段列表，单个IP视为只包含该地址的网段
+type addressList []*net.IPNet
+
+func (l *addressList) String() string {
+	return strings.Join(l.cidrs(), ",")
+}
+
+func (l *addressList) Set(value string) error {
+	var list addressList
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return fmt.Errorf("无效的地址: %s", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return fmt.Errorf("无效的网段: %s", item)
+		}
+		list = append(list, network)
+	}
+	*l = list
+	return nil
+}
+
+// 以CIDR形式列出所有网段
+func (l *addressList) cidrs() []string {
+	cidrs := make([]string, 0, len(*l))
+	for _, network := range *l {
+		cidrs = append(cidrs, network.String())
+	}
+	return cidrs
+}
+
+// 地址是否在列表中的某个网段内
+func (l *addressList) contains(ip net.IP) bool {
+	for _, network := range *l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 读取环境变量，未设置时使用默认值
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 内容索引条目：同一内容在磁盘上的所有存储路径，路径数即引用计数
+type contentEntry struct {
+	Size  int64
+	Paths map[string]bool
+}
+
+// 按内容哈希（SHA-256）索引已完成的文件，用于秒传和避免清理共享内容。
+// 索引只保存在内存中，服务重启后为空：重启前完成的文件不再参与秒传，秒传只在同一进程的生命周期内有效
+type contentIndex struct {
+	mu      sync.Mutex
+	entries map[string]*contentEntry // 内容哈希 -> 条目
+	hashes  map[string]string        // 存储路径 -> 内容哈希
+}
+
+var contents = &contentIndex{
+	entries: make(map[string]*contentEntry),
+	hashes:  make(map[string]string),
+}
+
+// 规范化可用于秒传的内容哈希，只接受SHA-256，MD5存在碰撞风险不参与去重
+func contentHashKey(fileHash string) (string, bool) {
+	fileHash = strings.ToLower(strings.TrimSpace(fileHash))
+	if len(fileHash) != 64 {
+		return "", false
+	}
+	for _, r := range fileHash {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return "", false
+		}
+	}
+	return fileHash, true
+}
+
+// 登记一个存储路径持有指定内容
+func (idx *contentIndex) add(hash string, size int64, path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.releaseLocked(path)
+
+	entry, exists := idx.entries[hash]
+	if !exists {
+		entry = &contentEntry{Size: size, Paths: make(map[string]bool)}
+		idx.entries[hash] = entry
+	}
+	entry.Paths[path] = true
+	idx.hashes[path] = hash
+}
+
+// 释放存储路径对内容的引用，引用数为0时删除索引条目
+func (idx *contentIndex) release(path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.releaseLocked(path)
+}
+
+func (idx *contentIndex) releaseLocked(path string) {
+	hash, exists := idx.hashes[path]
+	if !exists {
+		return
+	}
+	delete(idx.hashes, path)
+
+	if entry, exists := idx.entries[hash]; exists {
+		delete(entry.Paths, path)
+		if len(entry.Paths) == 0 {
+			delete(idx.entries, hash)
+		}
+	}
+}
+
+// 文件重命名或移动后更新索引中的路径
+func (idx *contentIndex) move(oldPath, newPath string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	hash, exists := idx.hashes[oldPath]
+	if !exists {
+		return
+	}
+	entry := idx.entries[hash]
+	delete(entry.Paths, oldPath)
+	delete(idx.hashes, oldPath)
+	entry.Paths[newPath] = true
+	idx.hashes[newPath] = hash
+}
+
+// 将已存在的相同内容链接到目标路径并登记引用，找不到可用内容时返回false
+func (idx *contentIndex) linkInto(hash string, size int64, target string) (bool, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entry, exists := idx.entries[hash]
+	if !exists || entry.Size != size {
+		return false, nil
+	}
+
+	for source := range entry.Paths {
+		if source == target {
+			return true, nil
+		}
+
+		// 源文件可能已被外部删除或截断，跳过并从索引中移除
+		if info, err := os.Stat(source); err != nil || info.Size() != size {
+			log.Printf("内容索引中的文件不可用，移除: %s", source)
+			idx.releaseLocked(source)
+			continue
+		}
+
+		if err := linkOrCopy(source, target); err != nil {
+			return false, err
+		}
+		// 硬链接共享修改时间，刷新后避免新会话的文件被当作过期文件清理
+		now := time.Now()
+		if err := os.Chtimes(target, now, now); err != nil {
+			log.Printf("更新文件时间失败 %s: %v", target, err)
+		}
+
+		entry.Paths[target] = true
+		idx.hashes[target] = hash
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// 优先使用硬链接共享内容，跨设备等情况下退回到复制
+func linkOrCopy(source, target string) error {
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err := os.Link(source, target)
+	if err == nil {
+		return nil
+	}
+	log.Printf("创建硬链接失败，改为复制文件 %s -> %s: %v", source, target, err)
+
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(target)
+		return fmt.Errorf("复制文件失败: %v", err)
+	}
+	return dst.Close()
+}
+
+// 删除存储文件并释放其内容引用。硬链接共享的内容在最后一个引用删除前仍保留在磁盘上
+func removeStoredFile(path string) error {
+	contents.release(path)
+	forgetConfig(path)
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestContentIndex() *contentIndex {
+	return &contentIndex{
+		entries: make(map[string]*contentEntry),
+		hashes:  make(map[string]string),
+	}
+}
+
+// 在临时目录中写入一个文件，返回路径
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestContentHashKey(t *testing.T) {
+	valid := strings.Repeat("ab", 32)
+	for _, test := range []struct {
+		input string
+		key   string
+		ok    bool
+	}{
+		{valid, valid, true},
+		{strings.ToUpper(valid), valid, true},
+		{" " + valid + "\n", valid, true},
+		{"", "", false},
+		{valid[:32], "", false},       // MD5长度
+		{valid + "00", "", false},     // 过长
+		{"zz" + valid[2:], "", false}, // 非十六进制字符
+	} {
+		key, ok := contentHashKey(test.input)
+		if key != test.key || ok != test.ok {
+			t.Errorf("contentHashKey(%q) = %q, %v，期望 %q, %v", test.input, key, ok, test.key, test.ok)
+		}
+	}
+}
+
+// 链接后的路径共享内容并计入引用，所有引用释放后不能再链接
+func TestContentIndexReferences(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("shared content")
+	hash := strings.Repeat("1", 64)
+	idx := newTestContentIndex()
+
+	source := writeTestFile(t, dir, "source", data)
+	idx.add(hash, int64(len(data)), source)
+
+	linked := filepath.Join(dir, "linked")
+	if ok, err := idx.linkInto(hash, int64(len(data)), linked); !ok || err != nil {
+		t.Fatalf("链接失败: %v, %v", ok, err)
+	}
+	if got, _ := os.ReadFile(linked); !bytes.Equal(got, data) {
+		t.Fatalf("链接的文件内容为 %q", got)
+	}
+
+	// 大小不同的请求不能使用已有内容
+	if ok, _ := idx.linkInto(hash, int64(len(data))+1, filepath.Join(dir, "other")); ok {
+		t.Fatal("大小不同的内容被链接")
+	}
+
+	// 释放一个引用后内容仍可用
+	idx.release(source)
+	os.Remove(source)
+	third := filepath.Join(dir, "third")
+	if ok, err := idx.linkInto(hash, int64(len(data)), third); !ok || err != nil {
+		t.Fatalf("释放一个引用后链接失败: %v, %v", ok, err)
+	}
+
+	// 重命名后旧路径不再被引用
+	moved := filepath.Join(dir, "moved")
+	if err := os.Rename(third, moved); err != nil {
+		t.Fatal(err)
+	}
+	idx.move(third, moved)
+	if _, exists := idx.hashes[third]; exists {
+		t.Fatal("重命名后旧路径仍在索引中")
+	}
+
+	idx.release(linked)
+	idx.release(moved)
+	if len(idx.entries) != 0 || len(idx.hashes) != 0 {
+		t.Fatalf("释放所有引用后索引不为空: %v, %v", idx.entries, idx.hashes)
+	}
+	if ok, _ := idx.linkInto(hash, int64(len(data)), filepath.Join(dir, "last")); ok {
+		t.Fatal("释放所有引用后仍可以链接")
+	}
+}
+
+// 磁盘上已被删除或截断的源文件从索引中移除，不会被链接
+func TestContentIndexUnavailableSource(t *testing.T) {
+	for name, damage := range map[string]func(path string) error{
+		"removed":   os.Remove,
+		"truncated": func(path string) error { return os.Truncate(path, 1) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := []byte("content that goes missing")
+			hash := strings.Repeat("2", 64)
+			idx := newTestContentIndex()
+
+			source := writeTestFile(t, dir, "source", data)
+			idx.add(hash, int64(len(data)), source)
+			if err := damage(source); err != nil {
+				t.Fatal(err)
+			}
+
+			if ok, err := idx.linkInto(hash, int64(len(data)), filepath.Join(dir, "target")); ok || err != nil {
+				t.Fatalf("链接了不可用的源文件: %v, %v", ok, err)
+			}
+			if _, exists := idx.entries[hash]; exists {
+				t.Fatal("不可用的源文件仍在索引中")
+			}
+		})
+	}
+}
+
+// 存储路径是与其他会话共享内容的硬链接时，在该路径开始新上传不会修改共享的内容
+func TestCreateKeepsSharedContent(t *testing.T) {
+	useTestStorage(t)
+	e := newTestEngine()
+
+	data := []byte("content shared with another session")
+	source := storagePath("dedup001", "a.bin")
+	if err := os.WriteFile(source, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := storagePath("dedup002", "a.bin")
+	if err := linkOrCopy(source, target); err != nil {
+		t.Fatal(err)
+	}
+
+	start, err := e.Begin(UploadStartRequest{SessionID: "dedup002", FileName: "a.bin", FileSize: 10})
+	if err != nil {
+		t.Fatalf("开始上传失败: %v", err)
+	}
+	t.Cleanup(func() {
+		store.mu.Lock()
+		delete(store.sessions, "dedup002")
+		store.mu.Unlock()
+		forgetConfig(start.ConfigPath)
+	})
+
+	if got, _ := os.ReadFile(source); !bytes.Equal(got, data) {
+		t.Fatalf("共享的内容被修改为 %q", got)
+	}
+	if info, err := os.Stat(target); err != nil || info.Size() != 10 {
+		t.Fatalf("新上传的文件没有预分配: %v, %v", info, err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// mDNS/DNS-SD 服务类型和域
+const (
+	mdnsService = "_lft._tcp"
+	mdnsDomain  = "local."
+)
+
+// 局域网内发现的服务实例
+type discoveredServer struct {
+	Instance string
+	URL      string
+	Version  string
+	TLS      bool
+}
+
+// 通过mDNS在局域网内广播服务，TXT记录包含版本号和TLS状态
+func startMDNSAdvertiser() (*zeroconf.Server, error) {
+	instance := serverConfig.MDNSInstance
+	if instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "lf-file-transfer"
+		}
+		instance = hostname
+	}
+
+	txt := []string{
+		"version=" + Version,
+		"tls=" + strconv.FormatBool(serverConfig.TLSEnabled()),
+	}
+
+	return zeroconf.Register(instance, mdnsService, mdnsDomain, serverConfig.Port, txt, nil)
+}
+
+// 在局域网内浏览服务实例，直到超时
+func browseServers(ctx context.Context) ([]discoveredServer, error) {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建mDNS解析器失败: %v", err)
+	}
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	found := make(map[string]discoveredServer)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for entry := range entries {
+			if server, ok := serverFromEntry(entry); ok {
+				found[server.Instance] = server
+			}
+		}
+	}()
+
+	if err := resolver.Browse(ctx, mdnsService, mdnsDomain, entries); err != nil {
+		return nil, fmt.Errorf("浏览mDNS服务失败: %v", err)
+	}
+
+	<-ctx.Done()
+	<-done
+
+	servers := make([]discoveredServer, 0, len(found))
+	for _, server := range found {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Instance < servers[j].Instance
+	})
+	return servers, nil
+}
+
+// 将mDNS解析结果转换为服务实例，优先使用IPv4地址
+func serverFromEntry(entry *zeroconf.ServiceEntry) (discoveredServer, bool) {
+	var ip net.IP
+	if len(entry.AddrIPv4) > 0 {
+		ip = entry.AddrIPv4[0]
+	} else if len(entry.AddrIPv6) > 0 {
+		ip = entry.AddrIPv6[0]
+	} else {
+		return discoveredServer{}, false
+	}
+
+	server := discoveredServer{Instance: entry.Instance}
+	for _, record := range entry.Text {
+		key, value, _ := strings.Cut(record, "=")
+		switch key {
+		case "version":
+			server.Version = value
+		case "tls":
+			server.TLS = value == "true"
+		}
+	}
+
+	scheme := "http"
+	if server.TLS {
+		scheme = "https"
+	}
+	server.URL = scheme + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(entry.Port))
+	return server, true
+}
+
+// discover 子命令：列出局域网内的服务实例
+func runDiscover(args []string) int {
+	fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 3*time.Second, "等待mDNS响应的时间")
+	first := fs.Bool("first", false, "只输出第一个发现的服务地址，便于脚本使用")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	servers, err := browseServers(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(servers) == 0 {
+		fmt.Fprintln(os.Stderr, "未在局域网内发现服务")
+		return 1
+	}
+
+	if *first {
+		fmt.Println(servers[0].URL)
+		return 0
+	}
+
+	for _, server := range servers {
+		fmt.Printf("%s\t%s\tversion=%s\ttls=%t\n", server.Instance, server.URL, server.Version, server.TLS)
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 开始心跳检测：设置读取超时，每次收到客户端的数据或pong时延长。
+// 笔记本合盖、网络中断等半开连接会因读取超时而断开，readPump随之退出并把客户端从会话中移除
+func (c *Client) startHeartbeat() {
+	c.conn.SetReadDeadline(time.Now().Add(serverConfig.PongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.extendReadDeadline()
+	})
+}
+
+// 收到客户端的数据后延长读取超时
+func (c *Client) extendReadDeadline() error {
+	return c.conn.SetReadDeadline(time.Now().Add(serverConfig.PongTimeout))
+}
+
+// 读取一条消息的数据时随读取进度延长读取超时。大文件的二进制帧在慢速网络上可能需要很长时间才能读完，
+// 期间客户端的pong排在帧之后无法送达，只要数据仍在到达就不应判定为心跳超时
+type heartbeatReader struct {
+	client   *Client
+	reader   io.Reader
+	extended time.Time
+}
+
+func (c *Client) heartbeatReader(r io.Reader) io.Reader {
+	return &heartbeatReader{client: c, reader: r, extended: time.Now()}
+}
+
+func (r *heartbeatReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	// 每秒最多延长一次，避免每次读取都重新设置超时
+	if n > 0 && time.Since(r.extended) >= time.Second {
+		r.client.extendReadDeadline()
+		r.extended = time.Now()
+	}
+	return n, err
+}
+
+// 向客户端写入一条消息，超过写入超时则失败（客户端不读取数据时不会永远阻塞）
+func (c *Client) write(messageType int, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(serverConfig.WriteTimeout))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// 发送心跳ping
+func (c *Client) ping() error {
+	return c.write(websocket.PingMessage, nil)
+}
+
+// 读取失败是否是因为心跳超时
+func isHeartbeatTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// 记录连接断开的原因
+func (c *Client) logDisconnect(sessionID string, err error) {
+	switch {
+	case isHeartbeatTimeout(err):
+		log.Printf("客户端 %s (%s) 在 %s 内没有响应心跳，断开与会话 %s 的连接", c.info.Nickname, c.info.ID, serverConfig.PongTimeout, sessionID)
+	case websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure):
+		log.Printf("error: %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 分片上传表单中普通字段的最大长度
+const maxChunkFieldSize = 4 << 10
+
+// WebSocket二进制帧中JSON头部的最大长度
+const maxFrameHeaderSize = 16 << 10
+
+// 一次HTTP分片上传：参数和尚未读取的分片数据
+type chunkUpload struct {
+	SessionID  string
+	FileName   string
+	ChunkIndex int
+	UploadID   string
+	Digest     string // 表单字段或查询参数中的chunkDigest
+	Body       io.Reader
+}
+
+// 解析分片上传请求，不读取分片数据。支持两种格式：
+//   - multipart/form-data：sessionID、fileName、chunkIndex、uploadID等字段需要在chunk字段之前
+//   - 原始请求体（如application/octet-stream）：参数通过查询字符串传递
+func readChunkUpload(c *gin.Context) (*chunkUpload, error) {
+	upload := &chunkUpload{}
+	var fields func(string) string
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader, err := c.Request.MultipartReader()
+		if err != nil {
+			return nil, newTransferError(http.StatusBadRequest, "解析表单失败")
+		}
+
+		values := make(map[string]string)
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil, newTransferError(http.StatusBadRequest, "获取分片文件失败")
+			}
+			if err != nil {
+				return nil, newTransferError(http.StatusBadRequest, "解析表单失败")
+			}
+			if part.FormName() == "chunk" {
+				// 分片数据留在请求体中，由传输引擎边读取边写入
+				upload.Body = part
+				break
+			}
+
+			value, err := io.ReadAll(io.LimitReader(part, maxChunkFieldSize+1))
+			if err != nil {
+				return nil, newTransferError(http.StatusBadRequest, "解析表单失败")
+			}
+			if len(value) > maxChunkFieldSize {
+				return nil, newTransferError(http.StatusBadRequest, "表单字段过长: "+part.FormName())
+			}
+			values[part.FormName()] = string(value)
+		}
+		fields = func(name string) string { return values[name] }
+	} else {
+		upload.Body = c.Request.Body
+		fields = c.Query
+	}
+
+	upload.SessionID = fields("sessionID")
+	upload.FileName = fields("fileName")
+	upload.UploadID = fields("uploadID")
+	upload.Digest = fields("chunkDigest")
+	chunkIndexStr := fields("chunkIndex")
+
+	if upload.SessionID == "" || upload.FileName == "" || chunkIndexStr == "" || upload.UploadID == "" {
+		return nil, newTransferError(http.StatusBadRequest, "缺少必要参数")
+	}
+
+	chunkIndex, err := strconv.Atoi(chunkIndexStr)
+	if err != nil {
+		return nil, newTransferError(http.StatusBadRequest, "分片索引无效")
+	}
+	upload.ChunkIndex = chunkIndex
+	return upload, nil
+}
+
+// 读取WebSocket二进制帧的头部。二进制帧由一行JSON头部（与文字消息的字段相同，不含data）和紧随其后的原始文件数据组成，
+// 返回的Reader从文件数据的第一个字节开始
+func readBinaryFrame(r io.Reader) (*Message, io.Reader, error) {
+	reader := bufio.NewReaderSize(r, maxFrameHeaderSize)
+	header, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, nil, errors.New("二进制帧头部过长")
+	}
+	if err != nil {
+		return nil, nil, errors.New("二进制帧缺少头部")
+	}
+
+	var msg Message
+	if err := json.Unmarshal(header, &msg); err != nil {
+		return nil, nil, err
+	}
+	return &msg, reader, nil
+}
+
+// 处理通过WebSocket发送的完整文件（JSON消息，文件数据为数字数组）
+func (c *Client) receiveFile(sessionID string, msg *Message) {
+	data := decodeMessageData(msg.Data)
+	if msg.Size != int64(len(data)) {
+		log.Printf("警告: 文件 %s 声明大小 %d 与实际数据大小 %d 不一致", msg.Name, msg.Size, len(data))
+	}
+	c.storeFile(sessionID, msg, int64(len(data)), bytes.NewReader(data))
+}
+
+// 处理通过WebSocket发送的文件块（JSON消息，文件数据为数字数组）
+func (c *Client) receiveFileChunk(sessionID string, msg *Message) {
+	c.storeFileChunk(sessionID, msg, bytes.NewReader(decodeMessageData(msg.Data)))
+}
+
+// 从r中读取size字节的完整文件，交给传输引擎按分片写入
+func (c *Client) storeFile(sessionID string, msg *Message, size int64, r io.Reader) {
+	start, err := transfers.Receive(UploadStartRequest{
+		SessionID: sessionID,
+		FileName:  msg.Name,
+		FileSize:  size,
+		ClientID:  c.info.ID,
+		To:        msg.To,
+	}, r)
+	if err != nil {
+		c.sendTransferError(sessionID, msg.Name, err)
+		return
+	}
+	if start.Existing != nil {
+		c.sendTransferError(sessionID, msg.Name, errors.New("会话中已存在同名文件"))
+	}
+}
+
+// 接收一个完整文件：开始（或继续）传输，从r中按顺序读取req.FileSize字节并按分片写入，断点续传时已完成的分片直接跳过。
+// 会话中已有同名文件时不读取数据，返回结果的Existing不为空。开始传输后读取或写入失败时同时返回开始的结果，调用方可以据此清理未完成的上传
+func (e *TransferEngine) Receive(req UploadStartRequest, r io.Reader) (*TransferStart, error) {
+	start, err := e.Begin(req)
+	if err != nil {
+		return nil, err
+	}
+	if start.Existing != nil || start.Completed {
+		return start, nil
+	}
+
+	missing := make(map[int]bool, len(start.MissingChunks))
+	for _, chunkIndex := range start.MissingChunks {
+		missing[chunkIndex] = true
+	}
+
+	// 数据按顺序到达，每个分片只读取自己的部分
+	for chunkIndex := 0; chunkIndex < start.TotalChunks; chunkIndex++ {
+		chunkSize := start.ChunkSize
+		if remaining := req.FileSize - int64(chunkIndex)*start.ChunkSize; remaining < chunkSize {
+			chunkSize = remaining
+		}
+		chunk := io.LimitReader(r, chunkSize)
+
+		if !missing[chunkIndex] {
+			if _, err := io.Copy(io.Discard, chunk); err != nil {
+				return start, err
+			}
+			continue
+		}
+		result, err := e.WriteChunk(req.SessionID, req.FileName, chunkIndex, chunk, defaultChunkHashAlgorithm, "")
+		if err != nil {
+			return start, err
+		}
+		start.Completed = result.Completed
+	}
+
+	// 空文件没有分片，需要显式完成
+	if start.TotalChunks == 0 {
+		if _, err := e.Complete(req.SessionID, req.FileName); err != nil {
+			return start, err
+		}
+		start.Completed = true
+	}
+	return start, nil
+}
+
+// 本连接是否已经开始了某个文件的分块上传
+func (c *Client) chunkUploadStarted(name string) bool {
+	c.chunkMu.Lock()
+	defer c.chunkMu.Unlock()
+	return c.chunkUploads[name]
+}
+
+// 记录或清除本连接开始的分块上传
+func (c *Client) setChunkUpload(name string, started bool) {
+	c.chunkMu.Lock()
+	defer c.chunkMu.Unlock()
+	if started {
+		c.chunkUploads[name] = true
+	} else {
+		delete(c.chunkUploads, name)
+	}
+}
+
+// 从r中读取一个文件块写入，本连接第一次收到某个文件的块时开始传输。
+// 文件块带有整个文件的哈希时，重新连接后可以继续其他连接或服务重启前留下的同名上传，否则重新开始
+func (c *Client) storeFileChunk(sessionID string, msg *Message, r io.Reader) {
+	if !c.chunkUploadStarted(msg.Name) {
+		// 块大小由客户端决定，未指定时为连接时告知的默认分片大小。
+		// 服务器无法把调整后的大小告知按块发送的客户端，超出范围时直接拒绝而不是调整
+		chunkSize := msg.ChunkSize
+		if chunkSize <= 0 {
+			chunkSize = transfers.ChunkSize
+		}
+		if chunkSize < transfers.MinChunkSize || chunkSize > transfers.MaxChunkSize {
+			c.sendTransferError(sessionID, msg.Name, newTransferError(http.StatusBadRequest,
+				fmt.Sprintf("块大小 %d 超出允许范围 %d ~ %d", chunkSize, transfers.MinChunkSize, transfers.MaxChunkSize)))
+			return
+		}
+		start, err := transfers.Begin(UploadStartRequest{
+			SessionID: sessionID,
+			FileName:  msg.Name,
+			FileSize:  msg.Size,
+			ChunkSize: chunkSize,
+			FileHash:  msg.FileHash,
+			ClientID:  c.info.ID,
+			To:        msg.To,
+		})
+		if err != nil {
+			c.sendTransferError(sessionID, msg.Name, err)
+			return
+		}
+		if start.Existing != nil {
+			c.sendTransferError(sessionID, msg.Name, errors.New("会话中已存在同名文件"))
+			return
+		}
+		if start.Completed {
+			return
+		}
+		c.setChunkUpload(msg.Name, true)
+		log.Printf("开始接收文件块: %s, 总块数: %d, 文件大小: %d", msg.Name, start.TotalChunks, msg.Size)
+	}
+
+	result, err := transfers.WriteChunk(sessionID, msg.Name, msg.CurrentChunk, r, defaultChunkHashAlgorithm, "")
+	if err != nil {
+		// 上传已被取消或清理，之后收到同名文件的块时重新开始
+		var transferErr *TransferError
+		if errors.As(err, &transferErr) && transferErr.Status == http.StatusNotFound {
+			c.setChunkUpload(msg.Name, false)
+		}
+		c.sendTransferError(sessionID, msg.Name, err)
+		return
+	}
+	if result.Completed {
+		c.setChunkUpload(msg.Name, false)
+	}
+	log.Printf("接收文件块: %s, 当前块: %d, 进度: %.1f%%", msg.Name, msg.CurrentChunk, result.Progress)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 断点续传状态的持久化方式：配置文件是某一时刻的快照，之后每完成（或重置）一个分片向日志文件追加一行，
+// 不再为每个分片重写整个配置文件。日志记录数超过分片数时把当前状态写入新快照并原子替换，然后删除日志，
+// 因此每个分片的平均开销与分片总数无关
+
+// 日志文件第一行的标记，后面是对应上传的创建时间，用于识别属于已被重新开始的上传的旧日志
+const journalMagic = "lft-journal"
+
+// 触发快照的最少日志记录数
+const minJournalRecords = 256
+
+// 断点续传日志文件路径
+func resumableJournalPath(configPath string) string {
+	return strings.TrimSuffix(configPath, ".json") + ".journal"
+}
+
+// 已加载的上传配置，避免每个分片都重新读取快照和重放日志。
+// 缓存的配置与快照文件的修改时间和大小以及日志的大小绑定，快照被替换或日志被追加（例如多节点部署时由其他节点写入）后重新加载
+type configCacheEntry struct {
+	config      *ResumableFileConfig
+	modTime     time.Time
+	size        int64
+	journalSize int64 // 没有日志时为-1
+}
+
+var configCache = struct {
+	sync.Mutex
+	entries map[string]*configCacheEntry
+}{entries: make(map[string]*configCacheEntry)}
+
+func cachedConfig(configPath string, info os.FileInfo) *ResumableFileConfig {
+	journalSize := resumableJournalSize(configPath)
+
+	configCache.Lock()
+	defer configCache.Unlock()
+
+	entry, exists := configCache.entries[configPath]
+	if !exists || !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() || entry.journalSize != journalSize {
+		return nil
+	}
+	return entry.config
+}
+
+func cacheConfig(configPath string, config *ResumableFileConfig) {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		forgetConfig(configPath)
+		return
+	}
+	journalSize := resumableJournalSize(configPath)
+
+	configCache.Lock()
+	configCache.entries[configPath] = &configCacheEntry{config: config, modTime: info.ModTime(), size: info.Size(), journalSize: journalSize}
+	configCache.Unlock()
+}
+
+// 日志文件的大小，日志不存在时返回-1
+func resumableJournalSize(configPath string) int64 {
+	info, err := os.Stat(resumableJournalPath(configPath))
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+func forgetConfig(configPath string) {
+	configCache.Lock()
+	delete(configCache.entries, configPath)
+	configCache.Unlock()
+}
+
+// 保存断点续传配置快照：写入临时文件并同步后原子替换，然后删除已经包含在快照中的日志
+func saveResumableConfig(configPath string, config *ResumableFileConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), filepath.Base(configPath)+".*.tmp")
+	if err != nil {
+		forgetConfig(configPath)
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), configPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		forgetConfig(configPath)
+		return err
+	}
+	syncDir(filepath.Dir(configPath))
+
+	// 快照已经包含日志中的所有记录，删除失败时重放也只会得到相同的状态
+	if err := os.Remove(resumableJournalPath(configPath)); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除上传日志失败 %s: %v", configPath, err)
+	}
+	config.journalRecords = 0
+	cacheConfig(configPath, config)
+	return nil
+}
+
+// 加载断点续传配置：读取快照并重放日志。已加载的配置直接从缓存返回，调用方需持有配置文件锁
+func loadResumableConfig(configPath string) (*ResumableFileConfig, error) {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		forgetConfig(configPath)
+		return nil, err
+	}
+	if config := cachedConfig(configPath, info); config != nil {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var config ResumableFileConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	config.normalizeChunks()
+
+	clean, err := config.replayJournal(resumableJournalPath(configPath))
+	if err != nil {
+		return nil, err
+	}
+	if !clean && !config.ownedByOtherNode() {
+		// 日志末尾不完整（写入时崩溃）或属于之前的上传，写入快照后丢弃，避免之后追加的记录与残缺的行连在一起。
+		// 其他节点的上传可能正在追加日志，只读取不修复
+		if err := saveResumableConfig(configPath, &config); err != nil {
+			return nil, err
+		}
+		return &config, nil
+	}
+
+	cacheConfig(configPath, &config)
+	return &config, nil
+}
+
+// 重放日志中的分片记录。日志不存在时返回true；日志末尾不完整或属于之前的上传时返回false
+func (config *ResumableFileConfig) replayJournal(journalPath string) (bool, error) {
+	data, err := os.ReadFile(journalPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	header := fmt.Sprintf("%s %d", journalMagic, config.CreatedAt.UnixNano())
+	clean := true
+	lines := bytes.Split(data, []byte("\n"))
+	if last := lines[len(lines)-1]; len(last) > 0 {
+		// 最后一行没有换行符，是写入时崩溃留下的残缺记录
+		clean = false
+	}
+	lines = lines[:len(lines)-1]
+
+	for _, line := range lines {
+		record := string(line)
+		if strings.HasPrefix(record, journalMagic) {
+			if record != header {
+				log.Printf("丢弃属于之前上传的日志: %s", journalPath)
+				return false, nil
+			}
+			continue
+		}
+		if !config.applyJournalRecord(record) {
+			log.Printf("忽略无效的上传日志记录 %s: %q", journalPath, record)
+			clean = false
+			continue
+		}
+		config.journalRecords++
+	}
+	return clean, nil
+}
+
+// 应用一条日志记录："+索引 算法=哈希" 表示分片完成，"-索引" 表示分片需要重新上传
+func (config *ResumableFileConfig) applyJournalRecord(record string) bool {
+	if len(record) < 2 {
+		return false
+	}
+	indexStr, digest, _ := strings.Cut(record[1:], " ")
+	index, err := strconv.Atoi(indexStr)
+	if err != nil || index < 0 || index >= config.TotalChunks {
+		return false
+	}
+
+	switch record[0] {
+	case '+':
+		algorithm, hash, found := strings.Cut(digest, "=")
+		if !found {
+			return false
+		}
+		config.completeChunk(index, algorithm, hash)
+	case '-':
+		config.resetChunk(index)
+	default:
+		return false
+	}
+	return true
+}
+
+// 把分片的当前状态追加到日志并同步到磁盘，日志记录足够多时写入新快照。调用方需持有配置文件锁
+func saveChunkState(configPath string, config *ResumableFileConfig, indexes ...int) error {
+	if config.journalRecords+len(indexes) >= minJournalRecords && config.journalRecords+len(indexes) >= config.TotalChunks {
+		return saveResumableConfig(configPath, config)
+	}
+
+	var buf bytes.Buffer
+	if config.journalRecords == 0 {
+		fmt.Fprintf(&buf, "%s %d\n", journalMagic, config.CreatedAt.UnixNano())
+	}
+	for _, i := range indexes {
+		if config.chunkCompleted(i) {
+			algorithm, hash := config.chunkHash(i)
+			fmt.Fprintf(&buf, "+%d %s=%s\n", i, algorithm, hash)
+		} else {
+			fmt.Fprintf(&buf, "-%d\n", i)
+		}
+	}
+
+	journal, err := os.OpenFile(resumableJournalPath(configPath), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		forgetConfig(configPath)
+		return err
+	}
+	_, err = journal.Write(buf.Bytes())
+	if err == nil {
+		err = journal.Sync()
+	}
+	if closeErr := journal.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// 内存中的状态与磁盘不一致，下次重新加载
+		forgetConfig(configPath)
+		return err
+	}
+
+	config.journalRecords += len(indexes)
+	cacheConfig(configPath, config)
+	return nil
+}
+
+// 删除断点续传配置快照和日志
+func removeResumableConfig(configPath string) error {
+	forgetConfig(configPath)
+	if err := os.Remove(resumableJournalPath(configPath)); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除上传日志失败 %s: %v", configPath, err)
+	}
+	return os.Remove(configPath)
+}
+
+// 同步目录，确保重命名后的文件在崩溃后仍然存在
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// 多节点部署时（-bus redis）进行中的上传只能由创建它的节点写入：配置缓存、文件锁和共享的文件句柄都是进程内的，
+// 其他节点写入会破坏快照和日志。本节点的ID，单节点部署时为空
+func uploadNode() string {
+	if serverConfig.Bus != "redis" {
+		return ""
+	}
+	return cluster.nodeID
+}
+
+// 上传是否由其他节点处理
+func (config *ResumableFileConfig) ownedByOtherNode() bool {
+	node := uploadNode()
+	return node != "" && config.Node != "" && config.Node != node
+}
+
+// 在其他节点上修改上传时返回的错误，负载均衡需要把同一会话的请求发送到同一个节点
+func errUploadOnOtherNode(config *ResumableFileConfig) *TransferError {
+	return &TransferError{
+		Status:  http.StatusMisdirectedRequest,
+		Message: fmt.Sprintf("上传由节点 %s 处理，请将请求发送到该节点", config.Node),
+		Fields:  gin.H{"node": config.Node},
+	}
+}
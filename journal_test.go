@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 在临时目录中运行测试：存储目录是相对于工作目录的 ../temp，切换到临时目录下的子目录
+func useTestStorage(t *testing.T) {
+	t.Helper()
+
+	root := t.TempDir()
+	workDir := filepath.Join(root, "run")
+	for _, dir := range []string{workDir, filepath.Join(root, "temp")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(workDir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+// 保存一个没有已完成分片的上传配置
+func newTestConfig(t *testing.T, sessionID, fileName string, totalChunks int) (string, *ResumableFileConfig) {
+	t.Helper()
+
+	configPath := resumableConfigPath(sessionID, fileName)
+	config := &ResumableFileConfig{
+		SessionID:    sessionID,
+		FileName:     fileName,
+		FileSize:     int64(totalChunks) * 16,
+		ChunkSize:    16,
+		TotalChunks:  totalChunks,
+		Completed:    newChunkBitmap(totalChunks),
+		ChunkHashes:  make([]string, totalChunks),
+		TempFilePath: storagePath(sessionID, fileName),
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+	if err := saveResumableConfig(configPath, config); err != nil {
+		t.Fatalf("保存配置失败: %v", err)
+	}
+	t.Cleanup(func() { forgetConfig(configPath) })
+	return configPath, config
+}
+
+func testChunkHash(i int) string {
+	return fmt.Sprintf("%064x", i+1)
+}
+
+// 丢弃缓存，从快照和日志重新加载配置
+func reloadConfig(t *testing.T, configPath string) *ResumableFileConfig {
+	t.Helper()
+
+	forgetConfig(configPath)
+	config, err := loadResumableConfig(configPath)
+	if err != nil {
+		t.Fatalf("加载配置失败: %v", err)
+	}
+	return config
+}
+
+// 检查重新加载的分片状态与期望一致
+func checkChunks(t *testing.T, config *ResumableFileConfig, completed map[int]bool) {
+	t.Helper()
+
+	for i := 0; i < config.TotalChunks; i++ {
+		if config.chunkCompleted(i) != completed[i] {
+			t.Fatalf("分片 %d 的完成状态为 %v，期望 %v", i, config.chunkCompleted(i), completed[i])
+		}
+		if !completed[i] {
+			continue
+		}
+		if algorithm, hash := config.chunkHash(i); algorithm != HashAlgorithmSHA256 || hash != testChunkHash(i) {
+			t.Fatalf("分片 %d 的哈希为 %s=%s", i, algorithm, hash)
+		}
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	useTestStorage(t)
+	configPath, config := newTestConfig(t, "journal1", "a.bin", 8)
+
+	for _, i := range []int{0, 3, 5} {
+		config.completeChunk(i, HashAlgorithmSHA256, testChunkHash(i))
+		if err := saveChunkState(configPath, config, i); err != nil {
+			t.Fatalf("追加日志失败: %v", err)
+		}
+	}
+	config.resetChunk(3)
+	if err := saveChunkState(configPath, config, 3); err != nil {
+		t.Fatalf("追加日志失败: %v", err)
+	}
+
+	reloaded := reloadConfig(t, configPath)
+	checkChunks(t, reloaded, map[int]bool{0: true, 5: true})
+	if reloaded.journalRecords != 4 {
+		t.Fatalf("重放了 %d 条日志记录，期望 4 条", reloaded.journalRecords)
+	}
+}
+
+func TestJournalReplayTornRecord(t *testing.T) {
+	for name, torn := range map[string]string{
+		"partial line": "+2 sha256=" + testChunkHash(2)[:20],
+		"partial hash": "+2 sha256=" + testChunkHash(2),
+		"index only":   "+2",
+	} {
+		t.Run(name, func(t *testing.T) {
+			useTestStorage(t)
+			configPath, config := newTestConfig(t, "journal2", "a.bin", 8)
+
+			for _, i := range []int{0, 1} {
+				config.completeChunk(i, HashAlgorithmSHA256, testChunkHash(i))
+				if err := saveChunkState(configPath, config, i); err != nil {
+					t.Fatalf("追加日志失败: %v", err)
+				}
+			}
+
+			// 写入最后一条记录时崩溃：没有换行符
+			journal, err := os.OpenFile(resumableJournalPath(configPath), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			journal.WriteString(torn)
+			journal.Close()
+
+			// 残缺的记录不生效，日志合并到快照后删除
+			reloaded := reloadConfig(t, configPath)
+			checkChunks(t, reloaded, map[int]bool{0: true, 1: true})
+			if _, err := os.Stat(resumableJournalPath(configPath)); !os.IsNotExist(err) {
+				t.Fatalf("修复后日志仍然存在: %v", err)
+			}
+
+			// 之后追加的记录不会与残缺的行连在一起
+			reloaded.completeChunk(2, HashAlgorithmSHA256, testChunkHash(2))
+			if err := saveChunkState(configPath, reloaded, 2); err != nil {
+				t.Fatalf("追加日志失败: %v", err)
+			}
+			checkChunks(t, reloadConfig(t, configPath), map[int]bool{0: true, 1: true, 2: true})
+		})
+	}
+}
+
+func TestJournalFromPreviousUpload(t *testing.T) {
+	useTestStorage(t)
+	configPath, config := newTestConfig(t, "journal3", "a.bin", 8)
+
+	config.completeChunk(0, HashAlgorithmSHA256, testChunkHash(0))
+	if err := saveChunkState(configPath, config, 0); err != nil {
+		t.Fatalf("追加日志失败: %v", err)
+	}
+	journal, err := os.ReadFile(resumableJournalPath(configPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新开始上传后写入新快照，旧上传的日志残留在磁盘上
+	_, restarted := newTestConfig(t, "journal3", "a.bin", 8)
+	restarted.CreatedAt = restarted.CreatedAt.Add(time.Second)
+	if err := saveResumableConfig(configPath, restarted); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(resumableJournalPath(configPath), journal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checkChunks(t, reloadConfig(t, configPath), nil)
+}
+
+func TestJournalCompaction(t *testing.T) {
+	useTestStorage(t)
+	const totalChunks = minJournalRecords + 44
+	configPath, config := newTestConfig(t, "journal4", "a.bin", totalChunks)
+
+	for i := 0; i < totalChunks-1; i++ {
+		config.completeChunk(i, HashAlgorithmSHA256, testChunkHash(i))
+		if err := saveChunkState(configPath, config, i); err != nil {
+			t.Fatalf("追加日志失败: %v", err)
+		}
+	}
+	if config.journalRecords != totalChunks-1 {
+		t.Fatalf("日志记录数为 %d，期望 %d", config.journalRecords, totalChunks-1)
+	}
+
+	// 记录数达到分片数时写入快照并删除日志
+	config.resetChunk(0)
+	if err := saveChunkState(configPath, config, 0); err != nil {
+		t.Fatalf("写入快照失败: %v", err)
+	}
+	if config.journalRecords != 0 {
+		t.Fatalf("写入快照后日志记录数为 %d", config.journalRecords)
+	}
+	if _, err := os.Stat(resumableJournalPath(configPath)); !os.IsNotExist(err) {
+		t.Fatalf("写入快照后日志仍然存在: %v", err)
+	}
+
+	completed := make(map[int]bool)
+	for i := 1; i < totalChunks-1; i++ {
+		completed[i] = true
+	}
+	checkChunks(t, reloadConfig(t, configPath), completed)
+}
+
+// 多个提交交替追加日志和触发快照，同时有读取者加载配置。每次读取都应看到一致的状态，
+// 最终从磁盘重新加载的状态与内存中的状态相同
+func TestJournalCompactionRacesAppend(t *testing.T) {
+	useTestStorage(t)
+	const totalChunks = minJournalRecords
+	configPath, _ := newTestConfig(t, "journal5", "a.bin", totalChunks)
+	configLock := resumableConfigLock(configPath)
+
+	// 每个写入者负责一部分分片，反复完成和重置，日志记录数多次超过分片数
+	const writers = 8
+	const rounds = 3
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*2)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				for i := w; i < totalChunks; i += writers {
+					configLock.Lock()
+					config, err := loadResumableConfig(configPath)
+					if err == nil {
+						if round%2 == 0 {
+							config.completeChunk(i, HashAlgorithmSHA256, testChunkHash(i))
+						} else {
+							config.resetChunk(i)
+						}
+						err = saveChunkState(configPath, config, i)
+					}
+					configLock.Unlock()
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				configLock.RLock()
+				config, err := loadResumableConfig(configPath)
+				if err == nil && config.completedChunks() > totalChunks {
+					err = fmt.Errorf("已完成分片数 %d 超过分片总数", config.completedChunks())
+				}
+				configLock.RUnlock()
+				if err != nil {
+					errs <- err
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("并发读写失败: %v", err)
+	}
+
+	// 最后一轮完成了所有分片
+	completed := make(map[int]bool)
+	for i := 0; i < totalChunks; i++ {
+		completed[i] = true
+	}
+	checkChunks(t, reloadConfig(t, configPath), completed)
+
+	// 没有残留的快照临时文件
+	entries, err := os.ReadDir(filepath.Dir(configPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Fatalf("残留快照临时文件: %s", entry.Name())
+		}
+	}
+}
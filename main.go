@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
 	"embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -13,10 +15,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -47,27 +50,39 @@ type Session struct {
 	ID             string
 	Clients        map[*Client]bool
 	TextContent    string
+	TextAuthor     *ClientInfo // 最后一次修改文字内容的客户端
 	FileInfo       *FileInfo
-	ReceivedFiles  map[string]*FileInfo      // 添加已接收文件映射，支持多个文件
-	ReceivingFiles map[string]*ReceivingFile // 添加正在接收的文件映射
+	ReceivedFiles  map[string]*FileInfo    // 添加已接收文件映射，支持多个文件
+	PendingUploads map[string]string       // 进行中的断点续传：文件名 -> 配置文件路径
+	ClientKeys     map[string]string       // 客户端ID -> 客户端密钥，用于定向传输的身份校验
+	RemoteRosters  map[string][]ClientInfo // 其他节点上的在线列表：节点ID -> 客户端
 	mu             sync.RWMutex
 }
 
 // Client 客户端连接
 type Client struct {
 	conn *websocket.Conn
-	send chan []byte
+	out  *outbox    // 发送队列
+	info ClientInfo // 客户端身份，修改时需持有会话锁
+
+	chunkMu      sync.Mutex
+	chunkUploads map[string]bool // 本连接开始的分块上传（文件名）。readPump和后台写入协程都会访问，需持有chunkMu
 }
 
 // FileInfo 文件信息
 type FileInfo struct {
-	Name         string   `json:"name"`
-	Size         int64    `json:"size"`
-	Data         []byte   `json:"data"`
-	Chunks       [][]byte `json:"chunks,omitempty"`       // 添加分块数据字段
-	TotalChunks  int      `json:"totalChunks,omitempty"`  // 总块数
-	CurrentChunk int      `json:"currentChunk,omitempty"` // 当前块索引
-	TempFilePath string   `json:"tempFilePath,omitempty"` // 临时文件路径
+	Name         string      `json:"name"`
+	Size         int64       `json:"size"`
+	Data         []byte      `json:"data"`
+	Chunks       [][]byte    `json:"chunks,omitempty"`       // 添加分块数据字段
+	TotalChunks  int         `json:"totalChunks,omitempty"`  // 总块数
+	CurrentChunk int         `json:"currentChunk,omitempty"` // 当前块索引
+	TempFilePath string      `json:"-"`                      // 磁盘上的存储路径，不对客户端公开
+	UploadedBy   *ClientInfo `json:"uploadedBy,omitempty"`   // 上传者
+	Recipients   []string    `json:"recipients,omitempty"`   // 定向传输的接收方客户端ID，为空表示所有人
+
+	DownloadCount int              `json:"downloadCount"`       // 完整下载次数
+	Downloads     []DownloadRecord `json:"downloads,omitempty"` // 最近的下载记录，修改时需持有会话锁
 }
 
 // Message 消息结构
@@ -82,50 +97,59 @@ type Message struct {
 	Clients      int         `json:"clients,omitempty"`      // 添加在线人数字段
 	Chunks       [][]byte    `json:"chunks,omitempty"`       // 添加分块数据字段
 	TotalChunks  int         `json:"totalChunks,omitempty"`  // 总块数
+	ChunkSize    int64       `json:"chunkSize,omitempty"`    // 每块的大小（file_chunk），省略时使用服务端的默认分片大小
+	FileHash     string      `json:"fileHash,omitempty"`     // 整个文件的SHA-256（file_chunk），提供时重新连接后可以从断点继续
 	CurrentChunk int         `json:"currentChunk,omitempty"` // 当前块索引
 	IsLastChunk  bool        `json:"isLastChunk,omitempty"`  // 是否为最后一块
-	TempFilePath string      `json:"tempFilePath,omitempty"` // 临时文件路径
-}
-
-// 添加一个用于存储正在接收的文件块的结构
-type ReceivingFile struct {
-	Name           string
-	Size           int64
-	Chunks         map[int][]byte
-	TotalChunks    int
-	ReceivedChunks int
-	TempFile       *os.File // 临时文件句柄
+	Stored       bool        `json:"stored,omitempty"`       // 文件已保存在服务器上，可以通过下载链接获取
+	From         *ClientInfo `json:"from,omitempty"`         // 发送者（聊天消息的作者或文件的上传者）
+	To           []string    `json:"to,omitempty"`           // 定向消息的接收方客户端ID，为空表示所有人
 }
 
 // 断点续传文件配置
 type ResumableFileConfig struct {
+	SessionID    string                `json:"sessionID,omitempty"` // 早期版本的配置没有此字段，从配置文件名中解析
 	FileName     string                `json:"fileName"`
 	FileSize     int64                 `json:"fileSize"`
 	FileHash     string                `json:"fileHash"`
 	ChunkSize    int64                 `json:"chunkSize"`
 	TotalChunks  int                   `json:"totalChunks"`
-	Chunks       map[string]*ChunkInfo `json:"chunks"`
+	Completed    chunkBitmap           `json:"completed"`        // 分片完成状态位图
+	ChunkHashes  []string              `json:"chunkHashes"`      // 已完成分片的 "算法=哈希"，按分片索引排列
+	Chunks       map[string]*ChunkInfo `json:"chunks,omitempty"` // 早期版本的分片记录，加载时转换为位图
 	TempFilePath string                `json:"tempFilePath"`
+	Uploader     *ClientInfo           `json:"uploader,omitempty"`
+	Recipients   []string              `json:"recipients,omitempty"`
+	Node         string                `json:"node,omitempty"` // 多节点部署时处理此上传的节点ID
 	CreatedAt    time.Time             `json:"createdAt"`
 	UpdatedAt    time.Time             `json:"updatedAt"`
-	mu           sync.RWMutex          `json:"-"`
+	Paused       bool                  `json:"paused,omitempty"`   // 上传已暂停，暂停期间拒绝写入分片
+	PausedBy     *ClientInfo           `json:"pausedBy,omitempty"` // 暂停上传的客户端，匿名请求时为空
+	PausedAt     *time.Time            `json:"pausedAt,omitempty"`
+
+	journalRecords int // 快照之后追加到日志的记录数
 }
 
-// 分片信息
+// 早期版本配置中的分片信息
 type ChunkInfo struct {
-	ChunkIndex int    `json:"chunkIndex"`
-	Size       int64  `json:"size"`
-	Hash       string `json:"hash"`
-	Completed  bool   `json:"completed"`
-	Offset     int64  `json:"offset"`
+	ChunkIndex    int    `json:"chunkIndex"`
+	Size          int64  `json:"size"`
+	Hash          string `json:"hash"`
+	HashAlgorithm string `json:"hashAlgorithm,omitempty"` // 为空表示早期版本的MD5
+	Completed     bool   `json:"completed"`
+	Offset        int64  `json:"offset"`
 }
 
 // 上传开始请求
 type UploadStartRequest struct {
-	SessionID string `json:"sessionID" binding:"required"`
-	FileName  string `json:"fileName" binding:"required"`
-	FileSize  int64  `json:"fileSize" binding:"required"`
-	FileHash  string `json:"fileHash"`
+	SessionID string   `json:"sessionID" binding:"required"`
+	FileName  string   `json:"fileName" binding:"required"`
+	FileSize  int64    `json:"fileSize" binding:"required"`
+	FileHash  string   `json:"fileHash"`
+	ChunkSize int64    `json:"chunkSize"` // 客户端建议的分片大小（可选），服务端限制在配置的范围内，实际大小以响应为准
+	ClientID  string   `json:"clientID"`  // 上传者的客户端ID（可选）
+	ClientKey string   `json:"clientKey"` // 上传者的客户端密钥，提供clientID时必须与之匹配
+	To        []string `json:"to"`        // 定向传输的接收方客户端ID（可选）
 }
 
 // 上传开始响应
@@ -139,15 +163,18 @@ type UploadStartResponse struct {
 
 // 上传状态查询响应
 type UploadStatusResponse struct {
-	UploadID        string  `json:"uploadID"`
-	FileName        string  `json:"fileName"`
-	FileSize        int64   `json:"fileSize"`
-	ChunkSize       int64   `json:"chunkSize"`
-	TotalChunks     int     `json:"totalChunks"`
-	CompletedChunks int     `json:"completedChunks"`
-	MissingChunks   []int   `json:"missingChunks"`
-	Progress        float64 `json:"progress"`
-	Completed       bool    `json:"completed"`
+	UploadID        string      `json:"uploadID"`
+	FileName        string      `json:"fileName"`
+	FileSize        int64       `json:"fileSize"`
+	ChunkSize       int64       `json:"chunkSize"`
+	TotalChunks     int         `json:"totalChunks"`
+	CompletedChunks int         `json:"completedChunks"`
+	MissingChunks   []int       `json:"missingChunks"`
+	Progress        float64     `json:"progress"`
+	Completed       bool        `json:"completed"`
+	Paused          bool        `json:"paused"`
+	PausedBy        *ClientInfo `json:"pausedBy,omitempty"`
+	PausedAt        *time.Time  `json:"pausedAt,omitempty"`
 }
 
 // 分片上传响应
@@ -164,6 +191,12 @@ const MaxFileSize = 100 * 1024 * 1024 * 1024 // 100GB
 // 定义块大小
 const ChunkSize = 1024 * 1024 * 5 // 5MB
 
+// 可配置的分片大小的上下限
+const (
+	MinChunkSize = 64 * 1024          // 64KB
+	MaxChunkSize = 1024 * 1024 * 1024 // 1GB
+)
+
 // 临时文件目录
 const TempDir = "../temp"
 
@@ -178,7 +211,35 @@ var store = &SessionStore{
 }
 
 func main() {
+	// 子命令：局域网服务发现
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		os.Exit(runDiscover(os.Args[2:]))
+	}
+
+	// 解析命令行参数
+	if err := parseConfig(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+
+	// 连接消息总线，多个节点通过它共享会话
+	if err := initCluster(); err != nil {
+		log.Fatalf("初始化集群失败: %v", err)
+	}
+
+	// WebSocket上传的文件数据由后台协程写入磁盘
+	diskWriters = newDiskWriterPool(serverConfig.DiskWriters)
+	transfers.ChunkSize = int64(serverConfig.ChunkSize)
+	transfers.MinChunkSize = int64(serverConfig.MinChunkSize)
+	transfers.MaxChunkSize = int64(serverConfig.MaxChunkSize)
+
 	r := gin.Default()
+	// 客户端地址（下载记录中的remoteAddr）同样只信任来自可信反向代理的X-Forwarded-For
+	if err := r.SetTrustedProxies(serverConfig.TrustedProxies.cidrs()); err != nil {
+		log.Fatalf("设置可信反向代理失败: %v", err)
+	}
+
+	// 校验所有路由中的会话ID
+	r.Use(sessionIDGuard())
 
 	// 创建临时目录（配置文件也存放在此目录）
 	err := os.MkdirAll(TempDir, 0755)
@@ -186,9 +247,15 @@ func main() {
 		log.Fatal("无法创建临时目录:", err)
 	}
 
+	// 从断点续传配置中恢复重启前的会话和未完成的上传
+	recoverResumableUploads()
+
 	// 启动定期清理temp目录的goroutine
 	go cleanupTempDir()
 
+	// 定期广播进行中上传的速度和剩余时间
+	go transfers.broadcastProgressLoop(serverConfig.ProgressInterval)
+
 	// 设置嵌入的静态文件服务
 	staticFS, err := fs.Sub(staticFiles, "public/static")
 	if err != nil {
@@ -201,50 +268,14 @@ func main() {
 	r.SetHTMLTemplate(templ)
 
 	// 添加下载临时文件的路由
-	r.GET("/download/:sessionID/:filename", func(c *gin.Context) {
-		sessionID := c.Param("sessionID")
-		filename := c.Param("filename")
-
-		log.Printf("收到文件下载请求: 会话ID=%s, 文件名=%s", sessionID, filename)
-
-		// 获取会话
-		session := store.GetOrCreateSession(sessionID)
-		session.mu.RLock()
+	r.GET("/download/:sessionID/:filename", downloadTempFile)
 
-		// 打印所有已接收的文件信息用于调试
-		log.Printf("会话 %s 中已接收的文件列表:", sessionID)
-		for name, info := range session.ReceivedFiles {
-			log.Printf("  文件: %s, 大小: %d, 路径: %s", name, info.Size, info.TempFilePath)
-		}
-
-		// 从已接收文件列表中查找文件
-		fileInfo, exists := session.ReceivedFiles[filename]
-		session.mu.RUnlock()
-
-		if !exists {
-			log.Printf("文件未找到: %s", filename)
-			c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
-			return
-		}
-
-		log.Printf("找到文件信息: 名称=%s, 大小=%d, 路径=%s", fileInfo.Name, fileInfo.Size, fileInfo.TempFilePath)
-
-		// 检查文件是否存在
-		if _, err := os.Stat(fileInfo.TempFilePath); os.IsNotExist(err) {
-			log.Printf("文件在磁盘上不存在: %s", fileInfo.TempFilePath)
-			c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
-			return
-		}
-
-		// 设置响应头
-		c.Header("Content-Description", "File Transfer")
-		c.Header("Content-Transfer-Encoding", "binary")
-		c.Header("Content-Disposition", "attachment; filename="+filename)
-		c.Header("Content-Type", "application/octet-stream")
-		log.Printf("下载文件路径: " + fileInfo.TempFilePath)
-		// 发送文件
-		c.File(fileInfo.TempFilePath)
-	})
+	// 命令行友好的上传、下载、文件列表和文字
+	r.PUT("/s/:sessionID/:filename", putSessionFile)
+	r.GET("/s/:sessionID/", listSessionFilesPlain)
+	r.GET("/s/:sessionID/:filename", downloadTempFile)
+	r.POST("/t/:sessionID", appendSessionText)
+	r.GET("/t/:sessionID", getSessionText)
 
 	// 主页路由
 	r.GET("/", func(c *gin.Context) {
@@ -280,38 +311,118 @@ func main() {
 	// API端点 - 获取会话历史
 	r.GET("/api/session/:sessionID/history", getSessionHistory)
 
+	// API端点 - 会话文件管理
+	r.GET("/api/session/:sessionID/files", listSessionFiles)
+	r.DELETE("/api/session/:sessionID/files/:name", deleteSessionFile)
+	r.POST("/api/session/:sessionID/files/:name/rename", renameSessionFile)
+
+	// API端点 - 会话共享链接二维码
+	r.GET("/api/session/:sessionID/qr.png", getSessionQRCodePNG)
+	r.GET("/api/session/:sessionID/qr.svg", getSessionQRCodeSVG)
+
 	// 断点续传API端点
 	r.POST("/api/upload/start", startResumableUpload)
 	r.POST("/api/upload/chunk", uploadChunk)
 	r.GET("/api/upload/status/:sessionID/:fileName", getUploadStatus)
 	r.POST("/api/upload/complete/:sessionID/:fileName", completeUpload)
+	r.POST("/api/upload/pause/:sessionID/:fileName", pauseUpload)
+	r.POST("/api/upload/resume/:sessionID/:fileName", resumePausedUpload)
+	r.DELETE("/api/upload/:sessionID/:fileName", cancelUpload)
+
+	// 在局域网内广播服务
+	if serverConfig.MDNSEnabled {
+		mdnsServer, err := startMDNSAdvertiser()
+		if err != nil {
+			log.Printf("mDNS服务广播失败: %v", err)
+		} else {
+			log.Printf("已通过mDNS广播服务 %s", mdnsService)
+			defer mdnsServer.Shutdown()
+		}
+	}
+
+	port := fmt.Sprintf(":%d", serverConfig.Port)
+	srv := &http.Server{
+		Addr:    port,
+		Handler: r,
+	}
+
+	// 监听退出信号，收到后优雅关闭
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("服务器启动在端口 %s...", port)
+		if serverConfig.TLSEnabled() {
+			serveErr <- srv.ListenAndServeTLS(serverConfig.TLSCertFile, serverConfig.TLSKeyFile)
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
 
-	port := ":9555"
-	log.Printf("服务器启动在端口 %s...", port)
-	if err := r.Run(port); err != nil {
-		log.Fatalf("服务器启动失败: %v", err)
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("服务器启动失败: %v", err)
+		}
+	case <-ctx.Done():
+		stop()
+		gracefulShutdown(srv)
 	}
 }
 
 // 下载临时文件
 func downloadTempFile(c *gin.Context) {
 	sessionID := c.Param("sessionID")
-	filename := c.Param("filename")
+	filename, err := sanitizeFileName(c.Param("filename"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("收到文件下载请求: 会话ID=%s, 文件名=%s", sessionID, filename)
 
 	session := store.GetOrCreateSession(sessionID)
 	session.mu.RLock()
 
 	// 从已接收文件列表中查找文件
 	fileInfo, exists := session.ReceivedFiles[filename]
+	configPath, pending := session.PendingUploads[filename]
+	clientID := requestClientID(c, session)
 	session.mu.RUnlock()
 
+	// 文件仍在上传中时边传边下
+	if !exists && pending {
+		senderID, recipients, err := pendingAudience(configPath)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+			return
+		}
+		if !canAccess(recipients, senderID, clientID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "无权下载此文件"})
+			return
+		}
+		streamIncompleteFile(c, sessionID, filename, configPath)
+		return
+	}
+
 	if !exists {
+		log.Printf("文件未找到: %s", filename)
 		c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
 		return
 	}
 
+	// 定向传输的文件只允许接收方和上传者下载
+	if !fileInfo.accessibleBy(clientID) {
+		log.Printf("拒绝未授权的下载: 会话ID=%s, 文件名=%s", sessionID, filename)
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权下载此文件"})
+		return
+	}
+
 	// 检查文件是否存在
-	if _, err := os.Stat(fileInfo.TempFilePath); os.IsNotExist(err) {
+	stat, err := os.Stat(fileInfo.TempFilePath)
+	if os.IsNotExist(err) {
+		log.Printf("文件在磁盘上不存在: %s", fileInfo.TempFilePath)
 		c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
 		return
 	}
@@ -319,39 +430,63 @@ func downloadTempFile(c *gin.Context) {
 	// 设置响应头
 	c.Header("Content-Description", "File Transfer")
 	c.Header("Content-Transfer-Encoding", "binary")
-	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.Header("Content-Disposition", contentDisposition(fileInfo.Name))
 	c.Header("Content-Type", "application/octet-stream")
 	log.Println("下载文件路径: " + fileInfo.TempFilePath)
 	// 发送文件
 	c.File(fileInfo.TempFilePath)
+
+	// 只有完整发送了文件内容才记录下载并通知上传者
+	if err == nil && downloadCompleted(c, stat.Size()) {
+		recordDownload(c, sessionID, filename, stat.Size(), false)
+	}
 }
 
 // 获取或创建会话
 func (s *SessionStore) GetOrCreateSession(sessionID string) *Session {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if session, exists := s.GetSession(sessionID); exists {
+		return session
+	}
 
+	s.mu.Lock()
 	if session, exists := s.sessions[sessionID]; exists {
+		s.mu.Unlock()
 		return session
 	}
 
 	session := &Session{
 		ID:             sessionID,
 		Clients:        make(map[*Client]bool),
-		ReceivedFiles:  make(map[string]*FileInfo),      // 初始化已接收文件映射
-		ReceivingFiles: make(map[string]*ReceivingFile), // 初始化正在接收的文件映射
+		ReceivedFiles:  make(map[string]*FileInfo), // 初始化已接收文件映射
+		PendingUploads: make(map[string]string),
+		ClientKeys:     make(map[string]string),
+		RemoteRosters:  make(map[string][]ClientInfo),
 	}
+	// 加载完成前持有会话锁，其他请求拿到会话后会等待加载完成
+	session.mu.Lock()
+	defer session.mu.Unlock()
 	s.sessions[sessionID] = session
+	s.mu.Unlock()
+
+	// 其他节点可能已经有这个会话，从共享存储加载文字内容、文件列表和在线列表。
+	// 加载可能涉及网络IO，不持有会话存储的锁，避免阻塞其他会话
+	session.loadMeta()
 	return session
 }
 
+// 获取已存在的会话
+func (s *SessionStore) GetSession(sessionID string) (*Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, exists := s.sessions[sessionID]
+	return session, exists
+}
+
 // 删除客户端
+// 只持有该会话的锁：会话中已没有客户端时才会在锁内删除文件，不会阻塞其他会话
 func (s *SessionStore) RemoveClient(client *Client, sessionID string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	log.Printf("尝试从会话 %s 删除客户端", sessionID)
-	if session, exists := s.sessions[sessionID]; exists {
+	if session, exists := s.GetSession(sessionID); exists {
 		session.mu.Lock()
 		defer session.mu.Unlock()
 		_, clientExists := session.Clients[client]
@@ -361,8 +496,22 @@ func (s *SessionStore) RemoveClient(client *Client, sessionID string) {
 		}
 
 		delete(session.Clients, client)
+		// 关闭发送队列，writePump随之退出
+		client.out.close()
 		log.Printf("客户端从会话 %s 断开，剩余客户端数: %d", sessionID, len(session.Clients))
 
+		// 服务关闭中时保留所有文件和上传配置，以便重启后继续
+		if uploadWrites.isDraining() {
+			log.Printf("服务器正在关闭，保留会话 %s 的资源", sessionID)
+			return
+		}
+
+		// 其他节点上还有客户端时保留会话资源（文件存放在共享目录中）
+		if len(session.Clients) == 0 && session.hasRemoteClients() {
+			log.Printf("会话 %s 在其他节点上仍有客户端连接，不执行清理", sessionID)
+			return
+		}
+
 		// 如果会话没有客户端了，清理资源
 		if len(session.Clients) == 0 {
 			log.Printf("会话 %s 没有客户端连接，开始清理资源", sessionID)
@@ -372,7 +521,7 @@ func (s *SessionStore) RemoveClient(client *Client, sessionID string) {
 				log.Printf("准备清理临时文件: %s", session.FileInfo.TempFilePath)
 				// 检查文件是否存在再删除
 				if _, err := os.Stat(session.FileInfo.TempFilePath); err == nil {
-					err := os.Remove(session.FileInfo.TempFilePath)
+					err := removeStoredFile(session.FileInfo.TempFilePath)
 					if err != nil {
 						log.Printf("删除临时文件失败: %v", err)
 					} else {
@@ -386,31 +535,6 @@ func (s *SessionStore) RemoveClient(client *Client, sessionID string) {
 				log.Printf("会话中没有需要清理的临时文件")
 			}
 
-			// 清理正在接收的文件
-			log.Printf("准备清理正在接收的文件，数量: %d", len(session.ReceivingFiles))
-			for name, receivingFile := range session.ReceivingFiles {
-				log.Printf("清理正在接收的文件: %s", name)
-				if receivingFile.TempFile != nil {
-					receivingFile.TempFile.Close()
-					log.Printf("已关闭正在接收的文件句柄: %s", name)
-				}
-				// 删除临时文件
-				tempFileName := filepath.Join(TempDir, session.ID+"_"+receivingFile.Name)
-				log.Printf("准备删除正在接收的临时文件: %s", tempFileName)
-				if _, err := os.Stat(tempFileName); err == nil {
-					err := os.Remove(tempFileName)
-					if err != nil {
-						log.Printf("删除正在接收的临时文件失败: %v", err)
-					} else {
-						log.Printf("已删除正在接收的临时文件: %s", tempFileName)
-					}
-				} else {
-					log.Printf("正在接收的临时文件不存在: %s", tempFileName)
-				}
-			}
-			// 清空接收文件映射
-			session.ReceivingFiles = make(map[string]*ReceivingFile)
-
 			// 清理已接收的文件
 			log.Printf("准备清理已接收的文件，数量: %d", len(session.ReceivedFiles))
 			for name, fileInfo := range session.ReceivedFiles {
@@ -418,7 +542,7 @@ func (s *SessionStore) RemoveClient(client *Client, sessionID string) {
 				if fileInfo.TempFilePath != "" {
 					log.Printf("准备删除已接收的临时文件: %s", fileInfo.TempFilePath)
 					if _, err := os.Stat(fileInfo.TempFilePath); err == nil {
-						err := os.Remove(fileInfo.TempFilePath)
+						err := removeStoredFile(fileInfo.TempFilePath)
 						if err != nil {
 							log.Printf("删除已接收的临时文件失败: %v", err)
 						} else {
@@ -431,11 +555,16 @@ func (s *SessionStore) RemoveClient(client *Client, sessionID string) {
 			}
 			// 清空已接收文件映射
 			session.ReceivedFiles = make(map[string]*FileInfo)
+			// 进行中的上传的临时文件和配置文件由下面的cleanupResumableConfigs一并删除
+			session.PendingUploads = make(map[string]string)
 
 			// 清理断点续传配置文件
 			log.Printf("准备清理断点续传配置文件")
 			cleanupResumableConfigs(sessionID)
 
+			// 清理共享存储中的会话元数据
+			session.dropMeta()
+
 			log.Printf("会话 %s 资源清理完成", sessionID)
 		} else {
 			log.Printf("会话 %s 仍有 %d 个客户端连接，不执行清理", sessionID, len(session.Clients))
@@ -502,7 +631,7 @@ func cleanupOrphanedFiles() {
 				filePath := filepath.Join(TempDir, fileName)
 				log.Printf("删除孤立文件: %s (会话 %s 不存在)", fileName, sessionID)
 
-				if err := os.Remove(filePath); err != nil {
+				if err := removeStoredFile(filePath); err != nil {
 					log.Printf("删除孤立文件失败: %v", err)
 				} else {
 					log.Printf("已删除孤立文件: %s", fileName)
@@ -545,12 +674,19 @@ func cleanupOldFiles() {
 			continue
 		}
 
-		// 检查文件是否超过24小时
-		if now.Sub(fileInfo.ModTime()) > 24*time.Hour {
+		// 检查文件是否超过24小时。上传配置快照在上传期间可能长时间不变，以日志的修改时间为准
+		modTime := fileInfo.ModTime()
+		if strings.HasSuffix(entry.Name(), ".json") {
+			if journalInfo, err := os.Stat(resumableJournalPath(filepath.Join(TempDir, entry.Name()))); err == nil && journalInfo.ModTime().After(modTime) {
+				modTime = journalInfo.ModTime()
+			}
+		}
+		if now.Sub(modTime) > 24*time.Hour {
 			filePath := filepath.Join(TempDir, entry.Name())
 			log.Printf("删除超过24小时的临时文件: %s", filePath)
 
-			if err := os.Remove(filePath); err != nil {
+			// 共享相同内容的其他路径是同一文件的硬链接，过期时间相同，各自删除并从内容索引中释放
+			if err := removeStoredFile(filePath); err != nil {
 				log.Printf("删除临时文件失败: %v", err)
 			} else {
 				log.Printf("已删除临时文件: %s", filePath)
@@ -563,14 +699,10 @@ func cleanupOldFiles() {
 
 // 从文件名中提取会话ID
 func extractSessionIDFromFileName(fileName string) string {
-	// 文件名格式：sessionID_filename 或 sessionID_filename.json
-	parts := strings.Split(fileName, "_")
-	if len(parts) >= 2 {
-		// 验证第一部分是否是有效的UUID格式
-		sessionID := parts[0]
-		if len(sessionID) == 36 && strings.Count(sessionID, "-") == 4 {
-			return sessionID
-		}
+	// 文件名格式：sessionID_存储键 或 sessionID_存储键.json，会话ID中不含下划线
+	sessionID, _, found := strings.Cut(fileName, "_")
+	if found && validateSessionID(sessionID) == nil {
+		return sessionID
 	}
 	return ""
 }
@@ -579,10 +711,17 @@ func extractSessionIDFromFileName(fileName string) string {
 func handleWebSocket(c *gin.Context) {
 	sessionID := c.Param("sessionID")
 
+	// 服务关闭中时不再接受新连接
+	if !wsConnections.begin() {
+		respondDraining(c)
+		return
+	}
+
 	// 升级到WebSocket连接
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Print("upgrade failed: ", err)
+		wsConnections.end()
 		return
 	}
 
@@ -592,7 +731,10 @@ func handleWebSocket(c *gin.Context) {
 	// 创建客户端
 	client := &Client{
 		conn: conn,
-		send: make(chan []byte, 1024), // 增加缓冲区大小以处理大文件
+		out:  newOutbox(sessionID),
+		info: newClientInfo(c),
+
+		chunkUploads: make(map[string]bool),
 	}
 
 	// 获取或创建会话
@@ -600,8 +742,23 @@ func handleWebSocket(c *gin.Context) {
 
 	// 注册客户端到会话
 	session.mu.Lock()
+	clientKey := session.bindClientKey(&client.info, c.Query("clientKey"))
 	session.Clients[client] = true
-	log.Printf("客户端连接到会话 %s，当前客户端数: %d", sessionID, len(session.Clients))
+	log.Printf("客户端 %s (%s) 连接到会话 %s，当前客户端数: %d", client.info.Nickname, client.info.ID, sessionID, len(session.Clients))
+
+	// 告知客户端自己的身份和密钥，客户端保存后重连时沿用
+	identityMsg := Message{
+		Type:      "identity",
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+		Data: identityData{
+			ClientInfo: client.info,
+			Key:        clientKey,
+		},
+	}
+	if data, err := json.Marshal(identityMsg); err == nil {
+		client.out.push(newOutboundMessage(identityMsg, data))
+	}
 
 	// 发送历史数据给新客户端
 	if session.TextContent != "" {
@@ -610,9 +767,10 @@ func handleWebSocket(c *gin.Context) {
 			Content:   session.TextContent,
 			SessionID: sessionID,
 			Timestamp: time.Now(),
+			From:      session.TextAuthor,
 		}
 		if data, err := json.Marshal(historyMsg); err == nil {
-			client.send <- data
+			client.out.push(newOutboundMessage(historyMsg, data))
 		}
 	}
 
@@ -621,12 +779,12 @@ func handleWebSocket(c *gin.Context) {
 	if session.FileInfo != nil {
 		log.Printf("发送历史文件数据给新客户端，文件名: %s", session.FileInfo.Name)
 		historyMsg := Message{
-			Type:         "file",
-			Name:         session.FileInfo.Name,
-			Size:         session.FileInfo.Size,
-			SessionID:    sessionID,
-			Timestamp:    time.Now(),
-			TempFilePath: session.FileInfo.TempFilePath,
+			Type:      "file",
+			Name:      session.FileInfo.Name,
+			Size:      session.FileInfo.Size,
+			SessionID: sessionID,
+			Timestamp: time.Now(),
+			Stored:    session.FileInfo.TempFilePath != "",
 		}
 
 		// 如果有临时文件路径，通知客户端可以通过下载链接获取文件
@@ -635,7 +793,7 @@ func handleWebSocket(c *gin.Context) {
 		}
 
 		if data, err := json.Marshal(historyMsg); err == nil {
-			client.send <- data
+			client.out.push(newOutboundMessage(historyMsg, data))
 			log.Printf("历史文件数据发送完成")
 		} else {
 			log.Printf("序列化历史文件数据失败: %v", err)
@@ -647,32 +805,37 @@ func handleWebSocket(c *gin.Context) {
 	// 发送所有已接收文件的历史数据
 	log.Printf("发送所有已接收文件的历史数据，文件数量: %d", len(session.ReceivedFiles))
 	for _, fileInfo := range session.ReceivedFiles {
+		// 定向传输的文件只发送给接收方和上传者
+		if !fileInfo.accessibleBy(client.info.ID) {
+			continue
+		}
 		log.Printf("发送已接收文件历史数据，文件名: %s, 大小: %d, 路径: %s", fileInfo.Name, fileInfo.Size, fileInfo.TempFilePath)
 		historyMsg := Message{
-			Type:         "file",
-			Name:         fileInfo.Name,
-			Size:         fileInfo.Size,
-			SessionID:    sessionID,
-			Timestamp:    time.Now(),
-			TempFilePath: fileInfo.TempFilePath,
-			Data:         "文件已保存在服务器上，可通过下载链接获取",
+			Type:      "file",
+			Name:      fileInfo.Name,
+			Size:      fileInfo.Size,
+			SessionID: sessionID,
+			Timestamp: time.Now(),
+			Stored:    true,
+			Data:      "文件已保存在服务器上，可通过下载链接获取",
+			From:      fileInfo.UploadedBy,
+			To:        fileInfo.Recipients,
 		}
 
 		if data, err := json.Marshal(historyMsg); err == nil {
-			client.send <- data
+			client.out.push(newOutboundMessage(historyMsg, data))
 			log.Printf("已接收文件历史数据发送完成: %s", fileInfo.Name)
 		} else {
 			log.Printf("序列化已接收文件历史数据失败: %v", err)
 		}
 	}
 
-	// 广播客户端数量更新
-	broadcastClientsCount(session)
-	session.mu.Unlock()
-
-	// 启动客户端处理goroutine
-	go client.writePump(sessionID)
-	go client.readPump(sessionID)
+	// 广播在线列表，同一客户端的其他连接已在线时不算新加入
+	event := "join"
+	if session.connectionCount(client.info.ID) > 1 {
+		event = "sync"
+	}
+	broadcastPresence(session, event, client.info)
 
 	// 发送欢迎消息
 	welcomeMsg := Message{
@@ -680,34 +843,55 @@ func handleWebSocket(c *gin.Context) {
 		Content:   "已连接到会话",
 		SessionID: sessionID,
 		Timestamp: time.Now(),
+		// 通过file_chunk上传时未指定chunkSize则使用默认分片大小，指定时需要在允许的范围内
+		Data: gin.H{
+			"chunkSize":    transfers.ChunkSize,
+			"minChunkSize": transfers.MinChunkSize,
+			"maxChunkSize": transfers.MaxChunkSize,
+		},
 	}
 	if data, err := json.Marshal(welcomeMsg); err == nil {
-		client.send <- data
+		client.out.push(newOutboundMessage(welcomeMsg, data))
 	}
+	session.mu.Unlock()
+
+	// 启动客户端处理goroutine
+	go client.writePump(sessionID)
+	go client.readPump(sessionID)
 }
 
-// writePump 处理向客户端写入消息
+// writePump 处理向客户端写入消息，并定期发送心跳ping。写入失败时关闭连接，readPump随之退出
 func (c *Client) writePump(sessionID string) {
+	ticker := time.NewTicker(serverConfig.PingInterval)
 	defer func() {
+		ticker.Stop()
 		c.conn.Close()
+		wsConnections.end()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
-			if !ok {
-				// 通道已关闭
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case <-c.out.ready:
+			for {
+				message, done := c.out.pop()
+				if done {
+					// 队列已关闭
+					c.write(websocket.CloseMessage, c.out.closeMessage())
+					return
+				}
+				if message == nil {
+					break
+				}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+				if err := c.write(websocket.TextMessage, message); err != nil {
+					log.Printf("向会话 %s 的客户端 %s 写入消息失败: %v", sessionID, c.info.ID, err)
+					return
+				}
 			}
-			w.Write(message)
 
-			if err := w.Close(); err != nil {
+		case <-ticker.C:
+			if err := c.ping(); err != nil {
+				log.Printf("向会话 %s 的客户端 %s 发送心跳失败: %v", sessionID, c.info.ID, err)
 				return
 			}
 		}
@@ -720,22 +904,39 @@ func (c *Client) readPump(sessionID string) {
 		store.RemoveClient(c, sessionID)
 		c.conn.Close()
 
-		// 获取会话并广播客户端数量更新
+		// 获取会话并广播在线列表，同一客户端还有其他连接时不算离开
 		session := store.GetOrCreateSession(sessionID)
 		session.mu.Lock()
-		broadcastClientsCount(session)
+		event := "leave"
+		if session.connectionCount(c.info.ID) > 0 {
+			event = "sync"
+		}
+		broadcastPresence(session, event, c.info)
 		session.mu.Unlock()
 	}()
 
 	// 设置读取限制为最大文件大小
 	c.conn.SetReadLimit(MaxFileSize)
+	c.startHeartbeat()
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		messageType, reader, err := c.conn.NextReader()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
+			c.logDisconnect(sessionID, err)
+			break
+		}
+		c.extendReadDeadline()
+		reader = c.heartbeatReader(reader)
+
+		// 二进制帧携带原始文件数据，直接写入磁盘
+		if messageType == websocket.BinaryMessage {
+			c.receiveBinaryFrame(sessionID, reader)
+			continue
+		}
+
+		message, err := io.ReadAll(reader)
+		if err != nil {
+			c.logDisconnect(sessionID, err)
 			break
 		}
 
@@ -746,239 +947,166 @@ func (c *Client) readPump(sessionID string) {
 			continue
 		}
 
-		// 获取会话
-		session := store.GetOrCreateSession(sessionID)
-		session.mu.Lock()
+		// 文件写入需要在服务关闭时被等待
+		isWrite := msg.Type == "file" || msg.Type == "file_chunk"
+		if isWrite {
+			name, err := sanitizeFileName(msg.Name)
+			if err != nil {
+				log.Printf("拒绝非法文件名 %q: %v", msg.Name, err)
+				continue
+			}
+			msg.Name = name
+		}
+		if isWrite && !uploadWrites.begin() {
+			log.Printf("服务器正在关闭，忽略会话 %s 的文件消息: %s", sessionID, msg.Name)
+			continue
+		}
 
 		// 根据消息类型处理
 		switch msg.Type {
 		case "text":
-			// 更新会话文字内容
-			session.TextContent = msg.Content
-
-			// 广播给所有客户端
-			broadcastMessage(message, session)
-
-		case "file":
-			// 创建临时文件存储大文件
-			tempFileName := filepath.Join(TempDir, sessionID+"_"+msg.Name)
-			tempFile, err := os.Create(tempFileName)
+			recipients, err := normalizeRecipients(msg.To)
 			if err != nil {
-				log.Printf("创建临时文件失败: %v", err)
-				session.mu.Unlock()
-				break
+				log.Printf("拒绝定向文字消息: %v", err)
+				continue
 			}
 
-			// 转换数据
-			var data []byte
-			if dataArray, ok := msg.Data.([]interface{}); ok {
-				data = make([]byte, len(dataArray))
-				for i, v := range dataArray {
-					if val, ok := v.(float64); ok {
-						data[i] = byte(val)
-					}
-				}
-			}
+			session := store.GetOrCreateSession(sessionID)
+			session.mu.Lock()
+			author := c.info
+			session.publishText(msg.Content, &author, recipients)
+			session.mu.Unlock()
 
-			// 写入临时文件
-			_, err = tempFile.Write(data)
-			if err != nil {
-				log.Printf("写入临时文件失败: %v", err)
-				// 关闭文件并同步状态
-				tempFile.Close()
-				session.mu.Unlock()
-				break
-			}
-
-			// 立即关闭文件，确保数据写入磁盘
-			tempFile.Close()
+		case "nickname":
+			// 修改昵称
+			c.rename(sessionID, msg.Content)
 
-			// 更新会话文件信息到已接收文件列表
-			fileInfo := &FileInfo{
-				Name:         msg.Name,
-				Size:         msg.Size,
-				TempFilePath: tempFileName,
-			}
-			session.ReceivedFiles[msg.Name] = fileInfo
-
-			log.Printf("更新已接收文件列表: 文件名=%s, 大小=%d, 路径=%s",
-				fileInfo.Name, fileInfo.Size, fileInfo.TempFilePath)
-
-			// 构造完整文件消息并广播
-			fullMsg := Message{
-				Type:         "file",
-				Name:         msg.Name,
-				Size:         msg.Size,
-				SessionID:    sessionID,
-				Timestamp:    time.Now(),
-				TempFilePath: tempFileName,
-				Data:         "文件已保存在服务器上，可通过下载链接获取",
-			}
-
-			// 广播给所有客户端
-			log.Printf("准备广播文件传输完成消息，会话ID: %s, 文件名: %s", sessionID, msg.Name)
-			broadcastMessage(fullMsg, session)
-			log.Printf("文件 %s 传输完成并广播给所有客户端", msg.Name)
+		case "file":
+			// 整个文件在一条消息中，交给传输引擎按分片写入。写入在后台进行，不阻塞同一连接的其他消息
+			diskWriters.submit(sessionID+"/"+msg.Name, func() {
+				defer uploadWrites.end()
+				c.receiveFile(sessionID, &msg)
+			})
 
 		case "file_chunk":
-			// 处理文件块 - 修复大文件处理逻辑
-			// 获取或创建正在接收的文件
-			receivingFile, exists := session.ReceivingFiles[msg.Name]
-			if !exists {
-				// 创建临时文件
-				tempFileName := filepath.Join(TempDir, sessionID+"_"+msg.Name)
-				tempFile, err := os.Create(tempFileName)
-				if err != nil {
-					log.Printf("创建临时文件失败: %v", err)
-					session.mu.Unlock()
-					break
-				}
-				// 预先分配文件空间
-				if err := tempFile.Truncate(msg.Size); err != nil {
-					log.Printf("预分配文件空间失败: %v", err)
-					tempFile.Close()
-					session.mu.Unlock()
-					break
-				}
+			diskWriters.submit(sessionID+"/"+msg.Name, func() {
+				defer uploadWrites.end()
+				c.receiveFileChunk(sessionID, &msg)
+			})
+		}
+	}
+}
 
-				receivingFile = &ReceivingFile{
-					Name:           msg.Name,
-					Size:           msg.Size,
-					Chunks:         make(map[int][]byte),
-					TotalChunks:    msg.TotalChunks,
-					ReceivedChunks: 0,
-					TempFile:       tempFile,
-				}
-				session.ReceivingFiles[msg.Name] = receivingFile
-				log.Printf("开始接收文件块: %s, 总块数: %d, 文件大小: %d", msg.Name, msg.TotalChunks, msg.Size)
-			} else {
-				// 如果已经存在但TotalChunks为0，则更新它
-				if receivingFile.TotalChunks == 0 && msg.TotalChunks > 0 {
-					receivingFile.TotalChunks = msg.TotalChunks
-					log.Printf("更新文件 %s 的总块数为: %d", msg.Name, msg.TotalChunks)
-				}
-			}
+// 处理二进制帧上传的文件或文件块。数据需要在读取下一条消息之前读完，因此直接在readPump中写入，
+// 写入期间同一连接的其他消息会等待（对上传方形成背压）
+func (c *Client) receiveBinaryFrame(sessionID string, reader io.Reader) {
+	msg, data, err := readBinaryFrame(reader)
+	if err != nil {
+		log.Printf("解析会话 %s 的二进制帧失败: %v", sessionID, err)
+		return
+	}
+	if msg.Type != "file" && msg.Type != "file_chunk" {
+		log.Printf("忽略会话 %s 的二进制帧: 不支持的消息类型 %q", sessionID, msg.Type)
+		return
+	}
 
-			// 转换数据
-			var data []byte
-			if dataArray, ok := msg.Data.([]interface{}); ok {
-				data = make([]byte, len(dataArray))
-				for i, v := range dataArray {
-					if val, ok := v.(float64); ok {
-						data[i] = byte(val)
-					}
-				}
-			}
+	name, err := sanitizeFileName(msg.Name)
+	if err != nil {
+		log.Printf("拒绝非法文件名 %q: %v", msg.Name, err)
+		return
+	}
+	msg.Name = name
 
-			// 存储文件块
-			receivingFile.Chunks[msg.CurrentChunk] = data
-			receivingFile.ReceivedChunks++
-			log.Printf("接收文件块: %s, 当前块: %d, 已接收: %d/%d",
-				msg.Name, msg.CurrentChunk, receivingFile.ReceivedChunks, receivingFile.TotalChunks)
-
-			// 直接写入临时文件（按顺序）
-			if msg.CurrentChunk == 0 {
-				// 第一块直接写入文件开始位置
-				log.Printf("开始写入第 %d 块到位置 0，块大小: %d", msg.CurrentChunk, len(data))
-				_, err := receivingFile.TempFile.WriteAt(data, 0)
-				if err != nil {
-					log.Printf("写入文件块失败: %v", err)
-					// 关闭文件并同步状态
-					receivingFile.TempFile.Close()
-					session.mu.Unlock()
-					break
-				}
-				// 立即同步到磁盘
-				receivingFile.TempFile.Sync()
-				log.Printf("完成写入第 %d 块到位置 0，块大小: %d", msg.CurrentChunk, len(data))
-			} else {
-				// 其他块写入对应位置
-				offset := int64(msg.CurrentChunk) * int64(ChunkSize)
-				log.Printf("开始写入第 %d 块到位置 %d，块大小: %d", msg.CurrentChunk, offset, len(data))
-				_, err := receivingFile.TempFile.WriteAt(data, offset)
-				if err != nil {
-					log.Printf("写入文件块失败: %v", err)
-					// 关闭文件并同步状态
-					receivingFile.TempFile.Close()
-					session.mu.Unlock()
-					break
-				}
-				// 立即同步到磁盘
-				receivingFile.TempFile.Sync()
-				log.Printf("完成写入第 %d 块到位置 %d，块大小: %d", msg.CurrentChunk, offset, len(data))
-			}
+	// 文件写入需要在服务关闭时被等待
+	if !uploadWrites.begin() {
+		log.Printf("服务器正在关闭，忽略会话 %s 的文件消息: %s", sessionID, msg.Name)
+		return
+	}
+	defer uploadWrites.end()
 
-			// 如果接收完所有块
-			// 检查是否接收了所有预期的块，即使TotalChunks未正确设置
-			allChunksReceived := false
-			if receivingFile.TotalChunks > 0 {
-				// 标准情况：TotalChunks已设置
-				allChunksReceived = (receivingFile.ReceivedChunks == receivingFile.TotalChunks)
-			} else {
-				// 特殊情况：TotalChunks未设置，根据文件大小计算
-				expectedChunks := int((receivingFile.Size + ChunkSize - 1) / ChunkSize)
-				allChunksReceived = (receivingFile.ReceivedChunks == expectedChunks)
-				log.Printf("TotalChunks未设置，根据文件大小计算预期块数: %d, 已接收: %d",
-					expectedChunks, receivingFile.ReceivedChunks)
-			}
+	if msg.Type == "file" {
+		c.storeFile(sessionID, msg, msg.Size, data)
+	} else {
+		c.storeFileChunk(sessionID, msg, data)
+	}
+}
 
-			// 如果接收完所有块
-			if allChunksReceived && receivingFile.ReceivedChunks > 0 {
-				log.Printf("文件 %s 接收完成，准备关闭文件", msg.Name)
-				// 确保所有数据都写入磁盘
-				receivingFile.TempFile.Sync()
-				log.Printf("文件 %s 数据同步完成，准备关闭文件句柄", msg.Name)
-				// 关闭临时文件
-				receivingFile.TempFile.Close()
-				log.Printf("文件 %s 文件句柄已关闭", msg.Name)
-
-				// 检查文件大小是否正确
-				filePath := filepath.Join(TempDir, sessionID+"_"+msg.Name)
-				if stat, err := os.Stat(filePath); err == nil {
-					log.Printf("文件 %s 传输完成，预期大小: %d, 实际大小: %d",
-						msg.Name, receivingFile.Size, stat.Size())
-					if stat.Size() != receivingFile.Size {
-						log.Printf("警告: 文件大小不匹配，期望: %d, 实际: %d", receivingFile.Size, stat.Size())
-					}
-				}
+// 将消息中的数字数组转换为字节数据
+func decodeMessageData(data interface{}) []byte {
+	dataArray, ok := data.([]interface{})
+	if !ok {
+		return nil
+	}
 
-				// 更新会话文件信息到已接收文件列表
-				fileInfo := &FileInfo{
-					Name:         receivingFile.Name,
-					Size:         receivingFile.Size,
-					TempFilePath: filepath.Join(TempDir, sessionID+"_"+receivingFile.Name),
-				}
-				session.ReceivedFiles[receivingFile.Name] = fileInfo
-
-				log.Printf("更新已接收文件列表: 文件名=%s, 大小=%d, 路径=%s",
-					fileInfo.Name, fileInfo.Size, fileInfo.TempFilePath)
-
-				// 构造完整文件消息并广播
-				fullMsg := Message{
-					Type:         "file",
-					Name:         receivingFile.Name,
-					Size:         receivingFile.Size,
-					SessionID:    sessionID,
-					Timestamp:    time.Now(),
-					TempFilePath: filepath.Join(TempDir, sessionID+"_"+receivingFile.Name),
-					Data:         "文件已保存在服务器上，可通过下载链接获取",
-				}
+	bytes := make([]byte, len(dataArray))
+	for i, v := range dataArray {
+		if val, ok := v.(float64); ok {
+			bytes[i] = byte(val)
+		}
+	}
+	return bytes
+}
 
-				// 广播给所有客户端
-				log.Printf("准备广播文件传输完成消息，会话ID: %s, 文件名: %s", sessionID, receivingFile.Name)
-				broadcastMessage(fullMsg, session)
-				log.Printf("文件 %s 传输完成并广播给所有客户端", receivingFile.Name)
+// 修改客户端昵称，同一客户端ID的所有连接一起修改，并广播在线列表
+func (c *Client) rename(sessionID, nickname string) {
+	nickname = sanitizeNickname(nickname)
+	if nickname == "" {
+		return
+	}
 
-				// 清理接收中的文件
-				delete(session.ReceivingFiles, receivingFile.Name)
-				log.Printf("已清理接收中的文件: %s", receivingFile.Name)
-			}
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	for client := range session.Clients {
+		if client.info.ID == c.info.ID {
+			client.info.Nickname = nickname
 		}
+	}
+	log.Printf("客户端 %s 修改昵称为: %s", c.info.ID, nickname)
+	broadcastPresence(session, "update", c.info)
+}
 
-		session.mu.Unlock()
+// 向当前客户端发送传输错误。只在客户端仍属于会话时发送，避免写入已关闭的通道
+func (c *Client) sendTransferError(sessionID, fileName string, err error) {
+	log.Printf("文件 %s 传输失败: %v", fileName, err)
+
+	data, marshalErr := json.Marshal(Message{
+		Type:      "error",
+		Content:   fmt.Sprintf("文件 %s 传输失败: %v", fileName, err),
+		Name:      fileName,
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+	})
+	if marshalErr != nil {
+		return
+	}
+
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.Clients[c] {
+		c.out.push(outboundMessage{Data: data, Priority: true})
 	}
 }
 
+// 更新会话文字内容，标记作者后广播给所有客户端。定向消息只发送给接收方，不保存为会话文字内容。调用方需持有会话锁
+func (s *Session) publishText(content string, author *ClientInfo, recipients []string) {
+	if len(recipients) == 0 {
+		s.TextContent = content
+		s.TextAuthor = author
+		s.setMeta(metaFieldText, textMeta{Content: content, Author: author})
+	}
+	broadcastToRecipients(Message{
+		Type:      "text",
+		Content:   content,
+		SessionID: s.ID,
+		Timestamp: time.Now(),
+		From:      author,
+		To:        recipients,
+	}, s, recipients, author.clientID())
+}
+
 // 广播消息给会话中的所有客户端
 func broadcastMessage(message interface{}, session *Session) {
 	var data []byte
@@ -997,46 +1125,33 @@ func broadcastMessage(message interface{}, session *Session) {
 		}
 	}
 
-	clientCount := len(session.Clients)
-	if clientCount == 0 {
-		log.Println("警告: 尝试向没有客户端的会话广播消息")
-		return
-	}
+	fanOut(newOutboundMessage(message, data), session, nil, "")
+}
 
+// 把消息加入本节点上可以看到该消息的客户端（recipients为空时发送给所有客户端）的发送队列。
+// 积压过久的客户端会被发送队列断开，之后由readPump从会话中移除。调用方需持有会话锁
+func deliverMessage(msg outboundMessage, session *Session, recipients []string, senderID string) {
+	clientCount := 0
 	successCount := 0
 	for client := range session.Clients {
-		select {
-		case client.send <- data:
+		if !canAccess(recipients, senderID, client.info.ID) {
+			continue
+		}
+		clientCount++
+		if client.out.push(msg) {
 			successCount++
-		default:
-			log.Println("警告: 无法向客户端发送消息，关闭连接")
-			close(client.send)
-			delete(session.Clients, client)
 		}
 	}
 
 	log.Printf("消息广播完成，成功发送给 %d/%d 个客户端", successCount, clientCount)
 }
 
-// 广播客户端数量给会话中的所有客户端
-func broadcastClientsCount(session *Session) {
-	clientsCount := len(session.Clients)
-
-	// 创建客户端数量消息
-	clientsMsg := Message{
-		Type:    "clients",
-		Clients: clientsCount,
-	}
-
-	// 将消息转换为JSON格式
-	if data, err := json.Marshal(clientsMsg); err == nil {
-		// 广播给所有客户端
-		broadcastMessage(data, session)
-	}
-}
-
 // 创建会话API
 func createSession(c *gin.Context) {
+	if rejectWhileDraining(c) {
+		return
+	}
+
 	var req struct {
 		Type      string `json:"type"`      // "text" 或 "file"
 		SessionID string `json:"sessionID"` // 可选的自定义会话ID
@@ -1051,6 +1166,9 @@ func createSession(c *gin.Context) {
 	sessionID := req.SessionID
 	if sessionID == "" {
 		sessionID = generateUUID()
+	} else if err := validateSessionID(sessionID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -1082,283 +1200,115 @@ func getSessionHistory(c *gin.Context) {
 
 // 开始断点续传上传
 func startResumableUpload(c *gin.Context) {
+	if rejectWhileDraining(c) {
+		return
+	}
+
 	var req UploadStartRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// 检查文件是否已经存在于会话中
-	session := store.GetOrCreateSession(req.SessionID)
-	session.mu.RLock()
-	if existingFile, exists := session.ReceivedFiles[req.FileName]; exists {
+	// 上传者身份会出现在文件信息中并决定定向传输的访问权限，需要校验客户端密钥
+	if req.ClientID != "" {
+		session := store.GetOrCreateSession(req.SessionID)
+		session.mu.RLock()
+		authenticated := session.authenticate(req.ClientID, req.ClientKey)
 		session.mu.RUnlock()
-		log.Printf("文件 %s 已经存在于会话中，返回已完成状态", req.FileName)
+		if !authenticated {
+			c.JSON(http.StatusForbidden, gin.H{"error": "客户端身份校验失败"})
+			return
+		}
+	}
+
+	start, err := transfers.Begin(req)
+	if err != nil {
+		respondTransferError(c, err)
+		return
+	}
+
+	switch {
+	case start.Existing != nil:
 		c.JSON(http.StatusOK, gin.H{
-			"uploadID": req.SessionID, // 使用sessionID作为uploadID
+			"uploadID": start.UploadID,
 			"config": map[string]interface{}{
-				"fileName":     req.FileName,
-				"fileSize":     existingFile.Size,
-				"totalChunks":  1,
-				"chunkSize":    existingFile.Size,
-				"chunks":       map[string]interface{}{"0": map[string]interface{}{"completed": true}},
-				"tempFilePath": existingFile.TempFilePath,
+				"fileName":    start.Existing.Name,
+				"fileSize":    start.Existing.Size,
+				"totalChunks": 1,
+				"chunkSize":   start.Existing.Size,
+				"chunks":      map[string]interface{}{"0": map[string]interface{}{"completed": true}},
 			},
 			"progress":      100,
 			"missingChunks": []int{},
 			"completed":     true,
 		})
-		return
-	}
-	session.mu.RUnlock()
-
-	// 生成上传ID
-	uploadID := generateUUID()
-
-	// 计算总分片数
-	totalChunks := int((req.FileSize + ChunkSize - 1) / ChunkSize)
-
-	// 添加详细的文件信息日志
-	log.Printf("开始处理文件: %s", req.FileName)
-	log.Printf("文件大小: %d 字节 (%.2f GB)", req.FileSize, float64(req.FileSize)/1024/1024/1024)
-	log.Printf("分片大小: %d 字节", ChunkSize)
-	log.Printf("计算分片数: %d", totalChunks)
-
-	// 创建配置文件
-	config := &ResumableFileConfig{
-		FileName:     req.FileName,
-		FileSize:     req.FileSize,
-		FileHash:     req.FileHash,
-		ChunkSize:    ChunkSize,
-		TotalChunks:  totalChunks,
-		Chunks:       make(map[string]*ChunkInfo),
-		TempFilePath: filepath.Join(TempDir, req.SessionID+"_"+req.FileName),
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
-	}
-
-	// 初始化分片信息
-	for i := 0; i < totalChunks; i++ {
-		var chunkSize int64 = ChunkSize
-		if i == totalChunks-1 {
-			// 最后一个分片可能小于标准大小
-			chunkSize = req.FileSize - int64(i)*ChunkSize
-		}
-
-		config.Chunks[strconv.Itoa(i)] = &ChunkInfo{
-			ChunkIndex: i,
-			Size:       chunkSize,
-			Hash:       "",
-			Completed:  false,
-			Offset:     int64(i) * ChunkSize,
-		}
-	}
-
-	// 保存配置文件（使用sessionID保持与源文件一致）
-	configPath := filepath.Join(ConfigDir, req.SessionID+"_"+req.FileName+".json")
-	if err := saveResumableConfig(configPath, config); err != nil {
-		log.Printf("保存配置文件失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置文件失败"})
-		return
-	}
-
-	// 创建临时文件并预分配空间
-	tempFile, err := os.Create(config.TempFilePath)
-	if err != nil {
-		log.Printf("创建临时文件失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建临时文件失败"})
-		return
+	case start.Completed:
+		c.JSON(http.StatusOK, gin.H{
+			"uploadID":      start.UploadID,
+			"chunkSize":     start.ChunkSize,
+			"totalChunks":   start.TotalChunks,
+			"missingChunks": []int{},
+			"progress":      100,
+			"completed":     true,
+			"deduplicated":  start.Deduplicated,
+			"resumed":       start.Resumed,
+		})
+	default:
+		c.JSON(http.StatusOK, UploadStartResponse{
+			UploadID:      start.UploadID,
+			ChunkSize:     start.ChunkSize,
+			TotalChunks:   start.TotalChunks,
+			MissingChunks: start.MissingChunks,
+			ConfigPath:    start.ConfigPath,
+		})
 	}
+}
 
-	// 预分配文件空间
-	if err := tempFile.Truncate(req.FileSize); err != nil {
-		log.Printf("预分配文件空间失败: %v", err)
-		tempFile.Close()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "预分配文件空间失败"})
+// 返回传输引擎的错误
+func respondTransferError(c *gin.Context, err error) {
+	if transferErr, ok := err.(*TransferError); ok {
+		c.JSON(transferErr.Status, transferErr.Response())
 		return
 	}
-	tempFile.Close()
-
-	// 获取缺失的分片列表
-	missingChunks := make([]int, 0, totalChunks)
-	for i := 0; i < totalChunks; i++ {
-		missingChunks = append(missingChunks, i)
-	}
-
-	response := UploadStartResponse{
-		UploadID:      uploadID,
-		ChunkSize:     ChunkSize,
-		TotalChunks:   totalChunks,
-		MissingChunks: missingChunks,
-		ConfigPath:    configPath,
-	}
-
-	c.JSON(http.StatusOK, response)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 }
 
 // 上传分片
 func uploadChunk(c *gin.Context) {
-	// 获取表单数据
-	sessionID := c.PostForm("sessionID")
-	fileName := c.PostForm("fileName")
-	chunkIndexStr := c.PostForm("chunkIndex")
-	uploadID := c.PostForm("uploadID")
-
-	if sessionID == "" || fileName == "" || chunkIndexStr == "" || uploadID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少必要参数"})
-		return
-	}
-
-	chunkIndex, err := strconv.Atoi(chunkIndexStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "分片索引无效"})
-		return
-	}
-
-	// 获取上传的文件
-	file, err := c.FormFile("chunk")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "获取分片文件失败"})
+	// 跟踪进行中的分片写入，服务关闭时等待其完成
+	if !uploadWrites.begin() {
+		respondDraining(c)
 		return
 	}
+	defer uploadWrites.end()
 
-	// 读取配置文件（使用sessionID）
-	configPath := filepath.Join(ConfigDir, sessionID+"_"+fileName+".json")
-
-	// 获取配置文件锁，确保并发安全
-	configLockKey := configPath
-	configLockValue, _ := fileLocks.LoadOrStore(configLockKey, &sync.RWMutex{})
-	configLock := configLockValue.(*sync.RWMutex)
-
-	configLock.Lock()
-	defer configLock.Unlock()
-
-	config, err := loadResumableConfig(configPath)
+	// 解析参数，分片数据边接收边写入，不在内存中缓存整个分片
+	upload, err := readChunkUpload(c)
 	if err != nil {
-		log.Printf("加载配置文件失败: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "上传配置不存在"})
-		return
-	}
-
-	// 检查分片是否已完成
-	chunkKey := strconv.Itoa(chunkIndex)
-	chunkInfo, exists := config.Chunks[chunkKey]
-	if !exists {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "分片索引超出范围"})
-		return
-	}
-
-	if chunkInfo.Completed {
-		// 分片已完成，返回成功
-		response := ChunkUploadResponse{
-			ChunkIndex: chunkIndex,
-			Completed:  false,
-			Progress:   calculateProgress(config),
-		}
-		c.JSON(http.StatusOK, response)
+		respondTransferError(c, err)
 		return
 	}
 
-	// 打开分片文件
-	src, err := file.Open()
+	// 客户端提供的分片摘要
+	hashAlgorithm, expectedDigest, err := chunkDigestFromRequest(c, upload.Digest)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "打开分片文件失败"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer src.Close()
 
-	// 读取分片数据
-	chunkData, err := io.ReadAll(src)
+	result, err := transfers.WriteChunk(upload.SessionID, upload.FileName, upload.ChunkIndex, upload.Body, hashAlgorithm, expectedDigest)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取分片数据失败"})
-		return
-	}
-
-	// 验证分片大小
-	if int64(len(chunkData)) != chunkInfo.Size {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "分片大小不匹配"})
+		respondTransferError(c, err)
 		return
 	}
 
-	// 计算分片哈希
-	hash := md5.Sum(chunkData)
-	chunkHash := hex.EncodeToString(hash[:])
-
-	// 使用安全的分片写入函数
-	if err := writeChunkSafely(config.TempFilePath, chunkData, chunkInfo.Offset); err != nil {
-		log.Printf("写入分片失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "写入分片失败"})
-		return
-	}
-
-	// 更新分片状态
-	chunkInfo.Hash = chunkHash
-	chunkInfo.Completed = true
-	config.UpdatedAt = time.Now()
-
-	// 保存配置文件
-	if err := saveResumableConfig(configPath, config); err != nil {
-		log.Printf("保存配置文件失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配置文件失败"})
-		return
-	}
-
-	// 检查是否所有分片都已完成
-	allCompleted := true
-	completedCount := 0
-	for _, chunk := range config.Chunks {
-		if chunk.Completed {
-			completedCount++
-		} else {
-			allCompleted = false
-		}
-	}
-
-	log.Printf("分片 %d 上传完成，总进度: %d/%d", chunkIndex, completedCount, config.TotalChunks)
-
-	response := ChunkUploadResponse{
-		ChunkIndex: chunkIndex,
-		Completed:  allCompleted,
-		Progress:   calculateProgress(config),
-	}
-
-	if allCompleted {
-		// 所有分片完成，添加到会话的已接收文件列表
-		session := store.GetOrCreateSession(sessionID)
-		session.mu.Lock()
-		session.ReceivedFiles[fileName] = &FileInfo{
-			Name:         fileName,
-			Size:         config.FileSize,
-			TempFilePath: config.TempFilePath,
-		}
-		session.mu.Unlock()
-
-		log.Printf("🎉 文件上传完成: %s (大小: %d 字节)", fileName, config.FileSize)
-
-		// 上传完成后删除配置文件
-		configPath := filepath.Join(ConfigDir, sessionID+"_"+fileName+".json")
-		if err := os.Remove(configPath); err != nil {
-			log.Printf("删除配置文件失败 %s: %v", configPath, err)
-		} else {
-			log.Printf("已删除配置文件: %s", configPath)
-		}
-
-		// 通过WebSocket通知接收端
-		message := Message{
-			Type:         "file",
-			Content:      fmt.Sprintf("文件上传完成: %s", fileName),
-			Name:         fileName,
-			Size:         config.FileSize,
-			SessionID:    sessionID,
-			Timestamp:    time.Now(),
-			TempFilePath: config.TempFilePath,
-		}
-
-		// 广播消息到会话中的所有客户端
-		broadcastMessage(message, session)
-	}
-
-	c.JSON(http.StatusOK, response)
+	c.JSON(http.StatusOK, ChunkUploadResponse{
+		ChunkIndex:    result.ChunkIndex,
+		Completed:     result.Completed,
+		Progress:      result.Progress,
+		MissingChunks: result.MissingChunks,
+	})
 }
 
 // 获取上传状态
@@ -1371,30 +1321,26 @@ func getUploadStatus(c *gin.Context) {
 		return
 	}
 
+	fileName, err := sanitizeFileName(fileName)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// 读取配置文件（使用sessionID查找）
-	configPath := filepath.Join(ConfigDir, sessionID+"_"+fileName+".json")
+	configPath := resumableConfigPath(sessionID, fileName)
+	configLock := resumableConfigLock(configPath)
+	configLock.RLock()
+	defer configLock.RUnlock()
+
 	config, err := loadResumableConfig(configPath)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "上传配置不存在"})
 		return
 	}
 
-	config.mu.RLock()
-	defer config.mu.RUnlock()
-
 	// 计算完成的分片数和缺失的分片
-	completedChunks := 0
-	missingChunks := make([]int, 0)
-
-	for i := 0; i < config.TotalChunks; i++ {
-		chunkKey := strconv.Itoa(i)
-		if chunk, exists := config.Chunks[chunkKey]; exists && chunk.Completed {
-			completedChunks++
-		} else {
-			missingChunks = append(missingChunks, i)
-		}
-	}
-
+	completedChunks := config.completedChunks()
 	allCompleted := completedChunks == config.TotalChunks
 
 	response := UploadStatusResponse{
@@ -1404,9 +1350,12 @@ func getUploadStatus(c *gin.Context) {
 		ChunkSize:       config.ChunkSize,
 		TotalChunks:     config.TotalChunks,
 		CompletedChunks: completedChunks,
-		MissingChunks:   missingChunks,
+		MissingChunks:   missingChunks(config),
 		Progress:        calculateProgress(config),
 		Completed:       allCompleted,
+		Paused:          config.Paused,
+		PausedBy:        config.PausedBy,
+		PausedAt:        config.PausedAt,
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -1422,98 +1371,29 @@ func completeUpload(c *gin.Context) {
 		return
 	}
 
-	// 读取配置文件
-	configPath := filepath.Join(ConfigDir, sessionID+"_"+fileName+".json")
-	config, err := loadResumableConfig(configPath)
+	fileName, err := sanitizeFileName(fileName)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "上传配置不存在"})
-		return
-	}
-
-	// 检查文件是否已经在会话中存在（可能已经完成）
-	session := store.GetOrCreateSession(sessionID)
-	session.mu.RLock()
-	if existingFile, exists := session.ReceivedFiles[fileName]; exists {
-		session.mu.RUnlock()
-		log.Printf("文件 %s 已经存在于会话中，直接返回成功", fileName)
-		c.JSON(http.StatusOK, gin.H{
-			"message":  "文件上传完成",
-			"fileName": fileName,
-			"fileSize": existingFile.Size,
-		})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	session.mu.RUnlock()
-
-	config.mu.Lock()
-	defer config.mu.Unlock()
 
-	// 验证所有分片都已完成
-	incompleteChunks := 0
-	for _, chunk := range config.Chunks {
-		if !chunk.Completed {
-			incompleteChunks++
-		}
-	}
-
-	if incompleteChunks > 0 {
-		log.Printf("文件 %s 还有 %d 个分片未完成上传", fileName, incompleteChunks)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":            fmt.Sprintf("还有 %d 个分片未完成上传", incompleteChunks),
-			"incompleteChunks": incompleteChunks,
-		})
+	fileSize, err := transfers.Complete(sessionID, fileName)
+	if err != nil {
+		respondTransferError(c, err)
 		return
 	}
 
-	// 验证文件完整性（可选）
-	if config.FileHash != "" {
-		if err := verifyFileHash(config.TempFilePath, config.FileHash); err != nil {
-			log.Printf("文件哈希验证失败: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "文件完整性验证失败"})
-			return
-		}
-	}
-
-	// 添加到会话的已接收文件列表
-	session.mu.Lock()
-	session.ReceivedFiles[fileName] = &FileInfo{
-		Name:         fileName,
-		Size:         config.FileSize,
-		TempFilePath: config.TempFilePath,
-	}
-	session.mu.Unlock()
-
-	log.Printf("文件上传完成并验证: %s", fileName)
-
 	c.JSON(http.StatusOK, gin.H{
 		"message":  "文件上传完成",
 		"fileName": fileName,
-		"fileSize": config.FileSize,
+		"fileSize": fileSize,
 	})
 }
 
-// 保存断点续传配置文件
-func saveResumableConfig(configPath string, config *ResumableFileConfig) error {
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(configPath, data, 0644)
-}
-
-// 加载断点续传配置文件
-func loadResumableConfig(configPath string) (*ResumableFileConfig, error) {
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, err
-	}
-
-	var config ResumableFileConfig
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, err
-	}
-
-	return &config, nil
+// 获取断点续传配置文件锁
+func resumableConfigLock(configPath string) *sync.RWMutex {
+	lockValue, _ := fileLocks.LoadOrStore(configPath, &sync.RWMutex{})
+	return lockValue.(*sync.RWMutex)
 }
 
 // 计算上传进度
@@ -1522,14 +1402,7 @@ func calculateProgress(config *ResumableFileConfig) float64 {
 		return 0
 	}
 
-	completedChunks := 0
-	for _, chunk := range config.Chunks {
-		if chunk.Completed {
-			completedChunks++
-		}
-	}
-
-	return float64(completedChunks) / float64(config.TotalChunks) * 100
+	return float64(config.completedChunks()) / float64(config.TotalChunks) * 100
 }
 
 // 验证文件哈希
@@ -1567,64 +1440,53 @@ func verifyFileHash(filePath, expectedHash string) error {
 	return nil
 }
 
-// 安全的分片写入函数，支持并发
-func writeChunkSafely(filePath string, data []byte, offset int64) error {
-	// 获取文件锁
-	lockKey := filePath
-	lockValue, _ := fileLocks.LoadOrStore(lockKey, &sync.Mutex{})
-	fileLock := lockValue.(*sync.Mutex)
-
-	fileLock.Lock()
-	defer fileLock.Unlock()
-
-	// 打开文件进行写入
-	file, err := os.OpenFile(filePath, os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("打开文件失败: %v", err)
-	}
-	defer file.Close()
-
-	// 写入指定位置
-	n, err := file.WriteAt(data, offset)
+// 从r中读取size字节写入文件的offset位置，返回实际写入的字节数。数据多于size字节时返回错误且不会写入分片范围之外。
+// 使用WriteAt写入，不同分片可以通过同一个文件句柄并发写入，数据由提交时统一同步到磁盘
+func writeChunkAt(file *os.File, offset, size int64, r io.Reader) (int64, error) {
+	written, err := io.Copy(io.NewOffsetWriter(file, offset), io.LimitReader(r, size))
 	if err != nil {
-		return fmt.Errorf("写入文件失败: %v", err)
-	}
-
-	if n != len(data) {
-		return fmt.Errorf("写入数据不完整: 期望 %d 字节, 实际写入 %d 字节", len(data), n)
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			log.Printf("写入文件失败: %v", err)
+			return written, newTransferError(http.StatusInternalServerError, "写入分片失败")
+		}
+		log.Printf("读取分片数据失败: %v", err)
+		return written, newTransferError(http.StatusBadRequest, "读取分片数据失败")
 	}
-
-	// 同步到磁盘
-	if err := file.Sync(); err != nil {
-		return fmt.Errorf("同步文件失败: %v", err)
+	if written == size {
+		var extra [1]byte
+		if n, _ := io.ReadFull(r, extra[:]); n > 0 {
+			return written, newTransferError(http.StatusBadRequest, "分片大小不匹配")
+		}
 	}
-
-	return nil
+	return written, nil
 }
 
 // 验证分片完整性
-func verifyChunkIntegrity(filePath string, offset int64, expectedSize int64, expectedHash string) error {
+func verifyChunkIntegrity(filePath string, offset int64, expectedSize int64, hashAlgorithm string, expectedHash string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("打开文件失败: %v", err)
 	}
 	defer file.Close()
 
-	// 读取指定位置的数据
-	data := make([]byte, expectedSize)
-	n, err := file.ReadAt(data, offset)
-	if err != nil && err != io.EOF {
+	// 流式读取指定位置的数据并计算哈希，不把整个分片读入内存
+	hasher, err := newChunkHasher(hashAlgorithm)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(hasher, io.NewSectionReader(file, offset, expectedSize))
+	if err != nil {
 		return fmt.Errorf("读取文件失败: %v", err)
 	}
 
-	if int64(n) != expectedSize {
+	if n != expectedSize {
 		return fmt.Errorf("读取数据大小不匹配: 期望 %d 字节, 实际读取 %d 字节", expectedSize, n)
 	}
 
 	// 验证哈希
 	if expectedHash != "" {
-		hash := md5.Sum(data)
-		actualHash := hex.EncodeToString(hash[:])
+		actualHash := hex.EncodeToString(hasher.Sum(nil))
 		if actualHash != expectedHash {
 			return fmt.Errorf("分片哈希不匹配: 期望 %s, 实际 %s", expectedHash, actualHash)
 		}
@@ -1660,9 +1522,9 @@ func cleanupResumableConfigs(sessionID string) {
 		filePath := filepath.Join(TempDir, fileName)
 
 		// 检查是否是以会话ID开头的文件（包括源文件和配置文件）
-		if len(fileName) > len(sessionID) && fileName[:len(sessionID)] == sessionID {
+		if strings.HasPrefix(fileName, sessionID+"_") {
 			// 删除文件
-			if err := os.Remove(filePath); err != nil {
+			if err := removeStoredFile(filePath); err != nil {
 				log.Printf("删除会话文件失败 %s: %v", fileName, err)
 				failedFiles = append(failedFiles, fileName)
 			} else {
@@ -1692,7 +1554,7 @@ func delayedCleanup(sessionID string, failedFiles []string) {
 		filePath := filepath.Join(TempDir, fileName)
 
 		// 再次尝试删除
-		if err := os.Remove(filePath); err != nil {
+		if err := removeStoredFile(filePath); err != nil {
 			log.Printf("延迟清理仍然失败 %s: %v", fileName, err)
 		} else {
 			log.Printf("延迟清理成功: %s", fileName)
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 发送队列的字节数上限，超过后与消息数量超过上限一样视为积压
+const maxOutboxBytes = 64 << 20
+
+// 发送给客户端的消息
+type outboundMessage struct {
+	Data     []byte
+	Priority bool   // 控制消息（在线列表、身份、错误等）优先于普通消息发送
+	Coalesce string // 非空时替换队列中尚未发送的同键消息，例如同一文件的传输进度
+}
+
+// 按消息类型决定发送优先级和合并键
+func newOutboundMessage(message interface{}, data []byte) outboundMessage {
+	out := outboundMessage{Data: data}
+
+	var msg *Message
+	switch m := message.(type) {
+	case Message:
+		msg = &m
+	case *Message:
+		msg = m
+	}
+	if msg == nil {
+		return out
+	}
+
+	switch msg.Type {
+	case "presence":
+		// 在线列表消息包含完整的成员列表，只需要发送最新的一条
+		out.Priority = true
+		out.Coalesce = "presence"
+	case "identity", "system", "error", "server_shutdown", "lagging", "file_downloaded":
+		out.Priority = true
+	case "transfer_progress":
+		out.Coalesce = "progress:" + msg.Name
+	}
+	return out
+}
+
+// lagging消息的数据
+type laggingData struct {
+	State           string `json:"state"` // lagging：消息开始积压；recovered：积压已消除
+	Queued          int    `json:"queued"`
+	DisconnectAfter int    `json:"disconnectAfter,omitempty"` // 仍未恢复时在多少秒后断开连接
+}
+
+// 队列中的一条消息
+type outboxEntry struct {
+	data     []byte
+	coalesce string
+}
+
+// 先进先出的消息队列，支持按键合并
+type outboxLane struct {
+	entries []*outboxEntry
+	keyed   map[string]*outboxEntry
+}
+
+func (l *outboxLane) push(msg outboundMessage) (added bool, delta int) {
+	if msg.Coalesce != "" {
+		if entry, exists := l.keyed[msg.Coalesce]; exists {
+			delta = len(msg.Data) - len(entry.data)
+			entry.data = msg.Data
+			return false, delta
+		}
+	}
+
+	entry := &outboxEntry{data: msg.Data, coalesce: msg.Coalesce}
+	l.entries = append(l.entries, entry)
+	if msg.Coalesce != "" {
+		if l.keyed == nil {
+			l.keyed = make(map[string]*outboxEntry)
+		}
+		l.keyed[msg.Coalesce] = entry
+	}
+	return true, len(msg.Data)
+}
+
+func (l *outboxLane) pop() *outboxEntry {
+	if len(l.entries) == 0 {
+		return nil
+	}
+	entry := l.entries[0]
+	l.entries[0] = nil
+	l.entries = l.entries[1:]
+	if entry.coalesce != "" {
+		delete(l.keyed, entry.coalesce)
+	}
+	return entry
+}
+
+// 客户端的发送队列：控制消息优先，传输进度等消息合并，积压时先通知客户端，
+// 超过积压时限或硬上限后断开连接，不会静默丢弃消息
+type outbox struct {
+	sessionID string
+
+	mu         sync.Mutex
+	control    outboxLane
+	normal     outboxLane
+	count      int
+	bytes      int
+	laggingAt  time.Time // 开始积压的时间，为零表示没有积压
+	closed     bool
+	aborted    bool
+	closeCode  int
+	closeText  string
+	ready      chan struct{}
+	closedOnce sync.Once
+}
+
+func newOutbox(sessionID string) *outbox {
+	return &outbox{
+		sessionID: sessionID,
+		ready:     make(chan struct{}, 1),
+	}
+}
+
+// 加入一条消息，返回false表示连接已关闭或因积压被断开
+func (o *outbox) push(msg outboundMessage) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return false
+	}
+
+	limit := serverConfig.SendQueueSize
+	if o.laggingAt.IsZero() && (o.count >= limit || o.bytes >= maxOutboxBytes) {
+		o.laggingAt = time.Now()
+		log.Printf("会话 %s 的客户端发送队列积压 %d 条消息，通知客户端", o.sessionID, o.count)
+		o.pushNotice(laggingData{
+			State:           "lagging",
+			Queued:          o.count,
+			DisconnectAfter: int(serverConfig.LagTimeout.Seconds()),
+		})
+	}
+	if !o.laggingAt.IsZero() && (o.count >= limit*4 || time.Since(o.laggingAt) > serverConfig.LagTimeout) {
+		log.Printf("会话 %s 的客户端发送队列积压 %d 条消息，已持续 %s，断开连接", o.sessionID, o.count, time.Since(o.laggingAt).Round(time.Millisecond))
+		o.abortLocked(websocket.CloseTryAgainLater, "发送队列积压")
+		return false
+	}
+
+	o.pushLocked(msg)
+	return true
+}
+
+func (o *outbox) pushLocked(msg outboundMessage) {
+	lane := &o.normal
+	if msg.Priority {
+		lane = &o.control
+	}
+	added, delta := lane.push(msg)
+	if added {
+		o.count++
+	}
+	o.bytes += delta
+
+	// 关闭后通道已被关闭，writePump会继续取出剩余的消息
+	if o.closed {
+		return
+	}
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// 加入积压状态通知，调用方需持有队列锁
+func (o *outbox) pushNotice(data laggingData) {
+	content := "网络较慢，消息正在积压"
+	if data.State == "recovered" {
+		content = "消息积压已消除"
+	}
+	encoded, err := json.Marshal(Message{
+		Type:      "lagging",
+		Content:   content,
+		SessionID: o.sessionID,
+		Timestamp: time.Now(),
+		Data:      data,
+	})
+	if err != nil {
+		return
+	}
+	o.pushLocked(outboundMessage{Data: encoded, Priority: true, Coalesce: "lagging"})
+}
+
+// 取出下一条待发送的消息。队列为空时返回nil；done为true表示队列已关闭且不再有消息
+func (o *outbox) pop() (data []byte, done bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.aborted {
+		return nil, true
+	}
+
+	entry := o.control.pop()
+	if entry == nil {
+		entry = o.normal.pop()
+	}
+	if entry == nil {
+		return nil, o.closed
+	}
+
+	o.count--
+	o.bytes -= len(entry.data)
+	if !o.laggingAt.IsZero() && o.count <= serverConfig.SendQueueSize/2 && o.bytes < maxOutboxBytes/2 {
+		log.Printf("会话 %s 的客户端发送队列积压已消除", o.sessionID)
+		o.laggingAt = time.Time{}
+		o.pushNotice(laggingData{State: "recovered", Queued: o.count})
+	}
+	return entry.data, false
+}
+
+// 关闭队列：已加入的消息发送完后再关闭连接
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closeLocked(websocket.CloseNormalClosure, "")
+}
+
+// 丢弃队列中的消息并立即关闭连接
+func (o *outbox) abortLocked(code int, text string) {
+	o.aborted = true
+	o.control = outboxLane{}
+	o.normal = outboxLane{}
+	o.count = 0
+	o.bytes = 0
+	o.closeLocked(code, text)
+}
+
+func (o *outbox) closeLocked(code int, text string) {
+	o.closedOnce.Do(func() {
+		o.closed = true
+		o.closeCode = code
+		o.closeText = text
+		close(o.ready)
+	})
+}
+
+// 关闭连接时发送的关闭帧
+func (o *outbox) closeMessage() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return websocket.FormatCloseMessage(o.closeCode, o.closeText)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 使用较小的队列长度和积压时限运行测试
+func useTestQueueLimits(t *testing.T, size int, lagTimeout time.Duration) {
+	t.Helper()
+
+	previousSize, previousTimeout := serverConfig.SendQueueSize, serverConfig.LagTimeout
+	serverConfig.SendQueueSize, serverConfig.LagTimeout = size, lagTimeout
+	t.Cleanup(func() {
+		serverConfig.SendQueueSize, serverConfig.LagTimeout = previousSize, previousTimeout
+	})
+}
+
+func testOutboundMessage(text string) outboundMessage {
+	return outboundMessage{Data: []byte(text)}
+}
+
+// 取出队列中的所有消息
+func drainOutbox(t *testing.T, o *outbox) []string {
+	t.Helper()
+
+	var messages []string
+	for {
+		data, done := o.pop()
+		if data == nil {
+			if done {
+				messages = append(messages, "<closed>")
+			}
+			return messages
+		}
+		messages = append(messages, string(data))
+	}
+}
+
+// 解析积压状态通知，不是通知时返回空状态
+func laggingState(data []byte) string {
+	var msg struct {
+		Type string
+		Data laggingData
+	}
+	if json.Unmarshal(data, &msg) != nil || msg.Type != "lagging" {
+		return ""
+	}
+	return msg.Data.State
+}
+
+func TestNewOutboundMessage(t *testing.T) {
+	for _, test := range []struct {
+		message  interface{}
+		priority bool
+		coalesce string
+	}{
+		{Message{Type: "text"}, false, ""},
+		{Message{Type: "file"}, false, ""},
+		{&Message{Type: "presence"}, true, "presence"},
+		{Message{Type: "identity"}, true, ""},
+		{Message{Type: "error"}, true, ""},
+		{Message{Type: "file_downloaded"}, true, ""},
+		{Message{Type: "transfer_progress", Name: "a.bin"}, false, "progress:a.bin"},
+		{map[string]string{"type": "presence"}, false, ""}, // 只识别Message
+	} {
+		out := newOutboundMessage(test.message, nil)
+		if out.Priority != test.priority || out.Coalesce != test.coalesce {
+			t.Errorf("newOutboundMessage(%+v) = 优先 %v, 合并键 %q，期望 %v, %q", test.message, out.Priority, out.Coalesce, test.priority, test.coalesce)
+		}
+	}
+}
+
+// 控制消息先于普通消息发送；同键消息在原位置替换为最新的内容，取出后再加入的同键消息重新排队
+func TestOutboxPriorityAndCoalescing(t *testing.T) {
+	useTestQueueLimits(t, 100, time.Minute)
+	o := newOutbox("outbox01")
+
+	for _, msg := range []outboundMessage{
+		testOutboundMessage("text-1"),
+		{Data: []byte("progress-a-1"), Coalesce: "progress:a"},
+		{Data: []byte("presence-1"), Priority: true, Coalesce: "presence"},
+		{Data: []byte("progress-b-1"), Coalesce: "progress:b"},
+		{Data: []byte("progress-a-2"), Coalesce: "progress:a"},
+		{Data: []byte("error-1"), Priority: true},
+		{Data: []byte("presence-2"), Priority: true, Coalesce: "presence"},
+		testOutboundMessage("text-2"),
+	} {
+		if !o.push(msg) {
+			t.Fatal("加入消息失败")
+		}
+	}
+
+	if o.count != 6 {
+		t.Fatalf("队列中有 %d 条消息，期望 6 条", o.count)
+	}
+	want := "[presence-2 error-1 text-1 progress-a-2 progress-b-1 text-2]"
+	if got := fmt.Sprint(drainOutbox(t, o)); got != want {
+		t.Fatalf("发送顺序为 %s，期望 %s", got, want)
+	}
+	if o.count != 0 || o.bytes != 0 {
+		t.Fatalf("取出所有消息后计数为 %d 条 %d 字节", o.count, o.bytes)
+	}
+
+	o.push(outboundMessage{Data: []byte("progress-a-3"), Coalesce: "progress:a"})
+	o.push(outboundMessage{Data: []byte("progress-a-4"), Coalesce: "progress:a"})
+	o.close()
+	if got := fmt.Sprint(drainOutbox(t, o)); got != "[progress-a-4 <closed>]" {
+		t.Fatalf("关闭后取出 %s", got)
+	}
+}
+
+// 积压超过队列长度时先通知客户端，积压减半后通知恢复
+func TestOutboxLaggingNotices(t *testing.T) {
+	useTestQueueLimits(t, 4, time.Minute)
+	o := newOutbox("outbox02")
+
+	for i := 0; i < 5; i++ {
+		if !o.push(testOutboundMessage(fmt.Sprintf("text-%d", i))) {
+			t.Fatalf("第 %d 条消息被拒绝", i)
+		}
+	}
+	if o.laggingAt.IsZero() {
+		t.Fatal("队列积压后没有进入积压状态")
+	}
+
+	// 积压通知优先发送，之后消息按顺序发送；积压减半时加入恢复通知，同样先于剩余的消息发送
+	var states []string
+	for {
+		data, _ := o.pop()
+		if data == nil {
+			break
+		}
+		if state := laggingState(data); state != "" {
+			states = append(states, fmt.Sprintf("%s@%d", state, o.count))
+		}
+	}
+	if got := fmt.Sprint(states); got != "[lagging@5 recovered@2]" {
+		t.Fatalf("积压状态通知为 %s", got)
+	}
+	if !o.laggingAt.IsZero() {
+		t.Fatal("取出消息后仍处于积压状态")
+	}
+}
+
+// 积压达到队列长度的4倍或超过积压时限时断开连接，丢弃队列中的消息
+func TestOutboxAbortsWhenLagging(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		lagTimeout time.Duration
+		pushes     int
+		wait       time.Duration
+	}{
+		{"queue limit", time.Minute, 4*4 - 1, 0}, // 积压通知也计入队列长度
+		{"lag timeout", 10 * time.Millisecond, 5, 20 * time.Millisecond},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			useTestQueueLimits(t, 4, test.lagTimeout)
+			o := newOutbox("outbox03")
+
+			for i := 0; i < test.pushes; i++ {
+				if !o.push(testOutboundMessage("text")) {
+					t.Fatalf("第 %d 条消息时提前断开", i)
+				}
+			}
+			time.Sleep(test.wait)
+
+			if o.push(testOutboundMessage("text")) {
+				t.Fatal("积压超过限制后仍然接受消息")
+			}
+			if data, done := o.pop(); data != nil || !done {
+				t.Fatal("断开后队列中仍有消息")
+			}
+			if o.push(testOutboundMessage("text")) {
+				t.Fatal("断开后仍然接受消息")
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 昵称最大长度（字符数）
+const maxNicknameLength = 32
+
+// 设备类型
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+)
+
+// 客户端身份：同一浏览器的多个连接共享稳定的客户端ID
+type ClientInfo struct {
+	ID       string    `json:"id"`
+	Nickname string    `json:"nickname"`
+	Device   string    `json:"device"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// 在线列表消息的数据
+type presenceData struct {
+	Event  string       `json:"event"` // join、leave、update 或 sync（同一客户端的其他连接变化）
+	Client ClientInfo   `json:"client"`
+	Roster []ClientInfo `json:"roster"`
+}
+
+// identity消息的数据：客户端身份和用于校验身份的密钥。密钥只发送给客户端自己
+type identityData struct {
+	ClientInfo
+	Key string `json:"key"`
+}
+
+// 客户端ID，身份为空时返回空字符串
+func (info *ClientInfo) clientID() string {
+	if info == nil {
+		return ""
+	}
+	return info.ID
+}
+
+// 根据WebSocket连接请求的查询参数生成客户端身份，缺少的字段自动生成或根据User-Agent推断
+func newClientInfo(c *gin.Context) ClientInfo {
+	info := ClientInfo{
+		ID:       c.Query("clientID"),
+		Nickname: sanitizeNickname(c.Query("nickname")),
+		Device:   c.Query("device"),
+		JoinedAt: time.Now(),
+	}
+
+	if validateSessionID(info.ID) != nil {
+		info.ID = generateUUID()
+	}
+	if info.Nickname == "" {
+		info.Nickname = randomNickname()
+	}
+	switch info.Device {
+	case DeviceDesktop, DeviceMobile, DeviceTablet:
+	default:
+		info.Device = detectDevice(c.Request.UserAgent())
+	}
+	return info
+}
+
+// 规范化昵称：去掉控制字符和首尾空白，并限制长度
+func sanitizeNickname(name string) string {
+	if !utf8.ValidString(name) {
+		return ""
+	}
+
+	var b strings.Builder
+	count := 0
+	for _, r := range strings.TrimSpace(name) {
+		if unicode.IsControl(r) {
+			continue
+		}
+		if count == maxNicknameLength {
+			break
+		}
+		b.WriteRune(r)
+		count++
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// 生成随机昵称
+func randomNickname() string {
+	buf := make([]byte, 2)
+	if _, err := rand.Read(buf); err != nil {
+		return "访客"
+	}
+	return "访客-" + hex.EncodeToString(buf)
+}
+
+// 根据User-Agent粗略判断设备类型
+func detectDevice(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") ||
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return DeviceTablet
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") || strings.Contains(ua, "android"):
+		return DeviceMobile
+	default:
+		return DeviceDesktop
+	}
+}
+
+// 会话中所有节点上的在线客户端列表，同一客户端ID的多个连接只出现一次。调用方需持有会话锁
+func (s *Session) roster() []ClientInfo {
+	roster := s.localRoster()
+	seen := make(map[string]bool, len(roster))
+	for _, info := range roster {
+		seen[info.ID] = true
+	}
+	for _, remote := range s.RemoteRosters {
+		for _, info := range remote {
+			if !seen[info.ID] {
+				seen[info.ID] = true
+				roster = append(roster, info)
+			}
+		}
+	}
+
+	sort.Slice(roster, func(i, j int) bool {
+		return roster[i].JoinedAt.Before(roster[j].JoinedAt)
+	})
+	return roster
+}
+
+// 连接到本节点的在线客户端列表。调用方需持有会话锁
+func (s *Session) localRoster() []ClientInfo {
+	seen := make(map[string]bool, len(s.Clients))
+	roster := make([]ClientInfo, 0, len(s.Clients))
+	for client := range s.Clients {
+		if seen[client.info.ID] {
+			continue
+		}
+		seen[client.info.ID] = true
+		roster = append(roster, client.info)
+	}
+	return roster
+}
+
+// 按客户端ID查找在线客户端（包括其他节点上的客户端）的身份。调用方需持有会话锁
+func (s *Session) clientInfo(clientID string) (ClientInfo, bool) {
+	for client := range s.Clients {
+		if client.info.ID == clientID {
+			return client.info, true
+		}
+	}
+	for _, remote := range s.RemoteRosters {
+		for _, info := range remote {
+			if info.ID == clientID {
+				return info, true
+			}
+		}
+	}
+	return ClientInfo{}, false
+}
+
+// 同一客户端ID在会话中的连接数。调用方需持有会话锁
+func (s *Session) connectionCount(clientID string) int {
+	count := 0
+	for client := range s.Clients {
+		if client.info.ID == clientID {
+			count++
+		}
+	}
+	return count
+}
+
+// 广播完整的在线列表和本次变化的事件，并把本节点的在线列表同步给其他节点。调用方需持有会话锁
+func broadcastPresence(session *Session, event string, client ClientInfo) {
+	session.saveRosterMeta()
+	roster := session.roster()
+	broadcastMessage(Message{
+		Type:      "presence",
+		SessionID: session.ID,
+		Timestamp: time.Now(),
+		Clients:   len(roster),
+		Data: presenceData{
+			Event:  event,
+			Client: client,
+			Roster: roster,
+		},
+	}, session)
+}
+
+// 查找上传者身份：优先使用在线客户端的信息，客户端不在线时只记录ID
+func resolveUploader(sessionID, clientID string) *ClientInfo {
+	if validateSessionID(clientID) != nil {
+		return nil
+	}
+
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	if info, ok := session.clientInfo(clientID); ok {
+		return &info
+	}
+	return &ClientInfo{ID: clientID}
+}
@@ -0,0 +1,134 @@
+// 客户端身份：同一浏览器的所有页面和连接共享稳定的客户端ID和昵称
+const Identity = (function () {
+    const CLIENT_ID_KEY = 'lft-client-id';
+    const NICKNAME_KEY = 'lft-nickname';
+    const CLIENT_KEY_KEY = 'lft-client-key';
+
+    function load(key) {
+        try {
+            return localStorage.getItem(key) || '';
+        } catch (e) {
+            return '';
+        }
+    }
+
+    function save(key, value) {
+        try {
+            localStorage.setItem(key, value);
+        } catch (e) {
+            console.warn("保存身份信息失败:", e);
+        }
+    }
+
+    // 生成客户端ID，格式与服务器的会话ID校验规则一致
+    function generateClientID() {
+        if (window.crypto && crypto.randomUUID) {
+            return crypto.randomUUID();
+        }
+        return 'xxxxxxxx-xxxx-4xxx-yxxx-xxxxxxxxxxxx'.replace(/[xy]/g, c => {
+            const r = Math.random() * 16 | 0;
+            return (c === 'x' ? r : (r & 0x3 | 0x8)).toString(16);
+        });
+    }
+
+    let clientID = load(CLIENT_ID_KEY);
+    if (!clientID) {
+        clientID = generateClientID();
+        save(CLIENT_ID_KEY, clientID);
+    }
+
+    return {
+        get clientID() {
+            return clientID;
+        },
+
+        get clientKey() {
+            return load(CLIENT_KEY_KEY);
+        },
+
+        get nickname() {
+            return load(NICKNAME_KEY);
+        },
+
+        // 带身份参数的WebSocket地址
+        wsURL(sessionID) {
+            const params = new URLSearchParams({ clientID: clientID });
+            const clientKey = load(CLIENT_KEY_KEY);
+            if (clientKey) {
+                params.set('clientKey', clientKey);
+            }
+            const nickname = load(NICKNAME_KEY);
+            if (nickname) {
+                params.set('nickname', nickname);
+            }
+            const protocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
+            return `${protocol}://${window.location.host}/ws/${sessionID}?${params}`;
+        },
+
+        // 为HTTP请求地址附加身份参数，定向传输的文件需要校验身份后才能下载和管理
+        withAuth(url) {
+            const params = new URLSearchParams({ clientID: clientID, clientKey: load(CLIENT_KEY_KEY) });
+            return url + (url.includes('?') ? '&' : '?') + params;
+        },
+
+        // 保存服务器分配的身份（首次连接时昵称和密钥由服务器生成）
+        remember(info) {
+            if (!info) {
+                return;
+            }
+            if (info.id && info.id !== clientID) {
+                clientID = info.id;
+                save(CLIENT_ID_KEY, clientID);
+            }
+            if (info.nickname) {
+                save(NICKNAME_KEY, info.nickname);
+            }
+            if (info.key) {
+                save(CLIENT_KEY_KEY, info.key);
+            }
+        },
+
+        // 修改昵称并通知会话中的其他成员
+        rename(ws, nickname) {
+            nickname = (nickname || '').trim();
+            if (!nickname) {
+                return;
+            }
+            save(NICKNAME_KEY, nickname);
+            if (ws && ws.readyState === WebSocket.OPEN) {
+                ws.send(JSON.stringify({ type: 'nickname', content: nickname }));
+            }
+        },
+
+        // 在线列表的显示文本
+        describeRoster(roster) {
+            return (roster || []).map(client => client.id === clientID ? `${client.nickname}（我）` : client.nickname).join('、');
+        },
+
+        // 文件列表中的上传者说明，昵称经过转义后可直接插入HTML
+        uploaderLabel(client) {
+            if (!client || !client.nickname) {
+                return '';
+            }
+            const span = document.createElement('span');
+            span.textContent = client.id === clientID ? '我' : client.nickname;
+            return ` | 来自 ${span.innerHTML}`;
+        },
+
+        // 定向传输的文件说明
+        recipientsLabel(recipients) {
+            return recipients && recipients.length > 0 ? ' | 仅指定成员可见' : '';
+        },
+
+        // 显示presence消息：更新在线人数并把成员昵称放在提示中
+        showPresence(element, message) {
+            if (!element) {
+                return;
+            }
+            element.textContent = message.clients;
+            if (message.data && message.data.roster) {
+                element.title = this.describeRoster(message.data.roster);
+            }
+        }
+    };
+})();
@@ -43,7 +43,7 @@ function updateSentFilesList() {
         fileItem.className = 'file-item';
         fileItem.innerHTML = `
             <p><strong>${file.name}</strong></p>
-            <p>大小: ${formatFileSize(file.size)}</p>
+            <p>大小: ${formatFileSize(file.size)}${file.downloadCount ? ` | 已被下载 ${file.downloadCount} 次` : ''}</p>
         `;
         sentFilesList.appendChild(fileItem);
     });
@@ -58,6 +58,16 @@ function formatFileSize(bytes) {
     return parseFloat((bytes / Math.pow(k, i)).toFixed(2)) + ' ' + sizes[i];
 }
 
+// 全局函数：服务器关闭后按提示的时间等待，服务恢复后执行回调
+function waitForServer(seconds, callback) {
+    const delay = (seconds || 10) * 1000;
+    setTimeout(function retry() {
+        fetch('/', { method: 'HEAD' })
+            .then(() => callback())
+            .catch(() => setTimeout(retry, delay));
+    }, delay);
+}
+
 document.addEventListener('DOMContentLoaded', function () {
     // 设置功能
     initializeSettings();
@@ -86,9 +96,11 @@ document.addEventListener('DOMContentLoaded', function () {
 
     let textWebSocket = null;
     let fileWebSocket = null;
+    let serverChunkSize = 0; // 服务端的分片大小，连接后由系统消息告知
     let textSessionID = null;
     let fileSessionID = null;
     let resumableManager = null;
+    let textInputBound = false;
 
     // 文字输入处理
     const textInput = document.getElementById('text-input');
@@ -110,7 +122,7 @@ document.addEventListener('DOMContentLoaded', function () {
 
     // 连接文字WebSocket
     function connectTextWebSocket(sessionID) {
-        textWebSocket = new WebSocket(`ws://${window.location.host}/ws/${sessionID}`);
+        textWebSocket = new WebSocket(Identity.wsURL(sessionID));
 
         textWebSocket.onopen = function (event) {
             console.log("文字传输WebSocket连接已建立");
@@ -126,11 +138,20 @@ document.addEventListener('DOMContentLoaded', function () {
                     case 'system':
                         console.log("系统消息:", message.content);
                         break;
-                    case 'clients':
-                        // 更新文字传输在线人数
-                        if (textOnlineCount) {
-                            textOnlineCount.textContent = message.clients;
-                        }
+                    case 'server_shutdown':
+                        console.log("服务器正在关闭，稍后重新连接文字传输:", message.content);
+                        waitForServer(message.data && message.data.reconnectAfter, () => connectTextWebSocket(sessionID));
+                        break;
+                    case 'identity':
+                        Identity.remember(message.data);
+                        break;
+                    case 'lagging':
+                        // 网络较慢时服务器提示消息积压，积压过久会断开连接
+                        console.warn(message.content, message.data);
+                        break;
+                    case 'presence':
+                        // 更新文字传输在线人数和成员列表
+                        Identity.showPresence(textOnlineCount, message);
                         break;
                 }
             } catch (e) {
@@ -146,7 +167,11 @@ document.addEventListener('DOMContentLoaded', function () {
             console.error("文字传输WebSocket错误:", error);
         };
 
-        // 监听文字输入变化
+        // 监听文字输入变化（重新连接时不重复绑定）
+        if (textInputBound) {
+            return;
+        }
+        textInputBound = true;
         let timeout;
         textInput.addEventListener('input', function () {
             // 防抖处理，避免过于频繁发送
@@ -253,7 +278,7 @@ document.addEventListener('DOMContentLoaded', function () {
 
     // 分块发送文件（优化大文件处理）
     function sendFileInChunks(file) {
-        const chunkSize = 1024 * 1024 * 5; // 将块大小增加到1MB，优化大文件传输效率
+        const chunkSize = serverChunkSize || 1024 * 1024 * 5; // 每块大小需要与服务端的分片大小一致
         const totalChunks = Math.ceil(file.size / chunkSize);
 
         // 记录传输开始时间
@@ -313,14 +338,15 @@ document.addEventListener('DOMContentLoaded', function () {
             const reader = new FileReader();
 
             reader.onload = function (e) {
+                // 以二进制帧发送：一行JSON头部后紧跟原始文件数据
                 const message = {
                     type: 'file_chunk',
                     name: file.name,
                     size: file.size,
-                    data: Array.from(new Uint8Array(e.target.result)),
                     sessionID: fileSessionID,
                     timestamp: new Date(),
                     totalChunks: totalChunks,
+                    chunkSize: chunkSize,
                     currentChunk: currentChunk,
                     isLastChunk: currentChunk === totalChunks - 1
                 };
@@ -334,7 +360,7 @@ document.addEventListener('DOMContentLoaded', function () {
                 const sendChunk = () => {
                     if (fileWebSocket && fileWebSocket.readyState === WebSocket.OPEN) {
                         try {
-                            fileWebSocket.send(JSON.stringify(message));
+                            fileWebSocket.send(new Blob([JSON.stringify(message) + '\n', e.target.result]));
                             sentChunks++;
                             currentChunk++;
                             totalSent += e.target.result.byteLength; // 更新已发送字节数
@@ -478,15 +504,53 @@ document.addEventListener('DOMContentLoaded', function () {
 
 
 
+    // 定向传输的接收方选择
+    const fileRecipients = document.getElementById('file-recipients');
+    if (fileRecipients) {
+        fileRecipients.addEventListener('change', function () {
+            if (resumableManager) {
+                resumableManager.recipients = selectedRecipients();
+            }
+        });
+    }
+
+    // 当前选择的接收方客户端ID
+    function selectedRecipients() {
+        if (!fileRecipients) {
+            return [];
+        }
+        return Array.from(fileRecipients.selectedOptions).map(option => option.value);
+    }
+
+    // 根据在线列表更新接收方选项（不包括自己），保留仍在线成员的选择状态
+    function updateRecipientOptions(roster) {
+        if (!fileRecipients || !roster) {
+            return;
+        }
+        const selected = new Set(selectedRecipients());
+        fileRecipients.innerHTML = '';
+        roster.filter(client => client.id !== Identity.clientID).forEach(client => {
+            const option = document.createElement('option');
+            option.value = client.id;
+            option.textContent = client.nickname;
+            option.selected = selected.has(client.id);
+            fileRecipients.appendChild(option);
+        });
+        if (resumableManager) {
+            resumableManager.recipients = selectedRecipients();
+        }
+    }
+
     // 连接文件WebSocket
     function connectFileWebSocket(sessionID) {
-        fileWebSocket = new WebSocket(`ws://${window.location.host}/ws/${sessionID}`);
+        fileWebSocket = new WebSocket(Identity.wsURL(sessionID));
 
         fileWebSocket.onopen = function (event) {
             console.log("文件传输WebSocket连接已建立");
 
             // 初始化断点续传管理器
             resumableManager = new ResumableUploadManager(sessionID, fileWebSocket);
+            resumableManager.recipients = selectedRecipients();
 
             // 暴露到全局作用域，方便调试和控制
             window.resumableManager = resumableManager;
@@ -499,6 +563,11 @@ document.addEventListener('DOMContentLoaded', function () {
                 const message = JSON.parse(event.data);
                 console.log("收到WebSocket消息:", message);
                 switch (message.type) {
+                    case 'system':
+                        if (message.data && message.data.chunkSize) {
+                            serverChunkSize = message.data.chunkSize;
+                        }
+                        break;
                     case 'file':
                         console.log("文件已发送完成:", message);
 
@@ -599,11 +668,52 @@ document.addEventListener('DOMContentLoaded', function () {
                             }
                         }
                         break;
-                    case 'clients':
-                        // 更新文件传输在线人数
-                        if (fileOnlineCount) {
-                            fileOnlineCount.textContent = message.clients;
+                    case 'upload_paused':
+                    case 'upload_resumed':
+                    case 'upload_cancelled':
+                        // 会话成员暂停、继续或取消了上传
+                        if (resumableManager) {
+                            resumableManager.handleControlMessage(message);
                         }
+                        break;
+                    case 'file_deleted':
+                        // 文件被删除后从已发送列表中移除
+                        sentFiles = sentFiles.filter(file => file.name !== message.name);
+                        updateSentFilesList();
+                        break;
+                    case 'file_renamed':
+                        // 文件被重命名后更新已发送列表
+                        sentFiles.forEach(file => {
+                            if (message.data && file.name === message.data.oldName) {
+                                file.name = message.name;
+                            }
+                        });
+                        updateSentFilesList();
+                        break;
+                    case 'file_downloaded':
+                        // 下载回执：其他成员完整下载了自己发送的文件
+                        sentFiles.forEach(file => {
+                            if (file.name === message.name && message.data) {
+                                file.downloadCount = message.data.downloadCount;
+                            }
+                        });
+                        updateSentFilesList();
+                        break;
+                    case 'server_shutdown':
+                        console.log("服务器正在关闭，稍后重新连接文件传输:", message.content);
+                        waitForServer(message.data && message.data.reconnectAfter, () => connectFileWebSocket(sessionID));
+                        break;
+                    case 'identity':
+                        Identity.remember(message.data);
+                        break;
+                    case 'lagging':
+                        // 网络较慢时服务器提示消息积压，积压过久会断开连接
+                        console.warn(message.content, message.data);
+                        break;
+                    case 'presence':
+                        // 更新文件传输在线人数和成员列表
+                        Identity.showPresence(fileOnlineCount, message);
+                        updateRecipientOptions(message.data && message.data.roster);
                         // 更新平台总在线会话数
                         const fileTotalSessions = document.getElementById('file-total-sessions');
                         if (fileTotalSessions && message.totalSessions !== undefined) {
@@ -41,6 +41,7 @@ class ResumableUploadManager {
         this.maxConcurrency = 3; // 最大并发数
         this.uploadQueue = []; // 上传队列
         this.activeUploads = 0; // 当前活跃上传数
+        this.recipients = []; // 定向传输的接收方客户端ID，为空时发送给所有人
 
         // 进度持久化
         this.storageKey = `resumable_uploads_${sessionID}`;
@@ -92,6 +93,8 @@ class ResumableUploadManager {
             uploadState.uploadID = null;
             uploadState.completed = false;
             uploadState.uploading = false;
+            uploadState.paused = false;
+            uploadState.cancelled = false;
             uploadState.progress = 0;
             uploadState.completedChunks.clear();
             uploadState.failedChunks.clear();
@@ -208,7 +211,10 @@ class ResumableUploadManager {
                     sessionID: this.sessionID,
                     fileName: uploadState.fileName,
                     fileSize: uploadState.fileSize,
-                    fileHash: uploadState.fileHash
+                    fileHash: uploadState.fileHash,
+                    clientID: Identity.clientID,
+                    clientKey: Identity.clientKey,
+                    to: this.recipients
                 })
             });
 
@@ -216,6 +222,13 @@ class ResumableUploadManager {
             console.log(`服务端响应:`, result);
 
             if (response.ok) {
+                // 服务器上已有相同内容（秒传），或之前的上传只差完成步骤
+                if (result.deduplicated || result.resumed) {
+                    console.log(`上传完成（无需上传分片）: ${uploadState.file.name}`);
+                    this.onUploadComplete(uploadState);
+                    return;
+                }
+
                 // 检查是否已经完成
                 if (result.completed) {
                     console.log(`文件已经完成上传: ${uploadState.file.name}`);
@@ -247,6 +260,17 @@ class ResumableUploadManager {
                 uploadState.uploadID = result.uploadID;
                 uploadState.missingChunks = result.missingChunks || [];
                 uploadState.totalChunks = result.totalChunks;
+                // 分片大小由服务端决定，可能与本地默认值不同
+                uploadState.chunkSize = result.chunkSize || this.chunkSize;
+
+                // 服务端可能从断点继续（例如服务重启后），不在缺失列表中的分片都已完成
+                const missing = new Set(uploadState.missingChunks);
+                uploadState.completedChunks = new Set();
+                for (let i = 0; i < uploadState.totalChunks; i++) {
+                    if (!missing.has(i)) {
+                        uploadState.completedChunks.add(i);
+                    }
+                }
 
                 console.log(`开始上传文件: ${uploadState.fileName}, 上传ID: ${uploadState.uploadID}, 缺失分片: ${uploadState.missingChunks.length}`);
 
@@ -288,7 +312,10 @@ class ResumableUploadManager {
                 sessionID: this.sessionID,
                 fileName: uploadState.file.name,
                 fileSize: uploadState.file.size,
-                fileHash: '' // 可以添加文件哈希计算
+                fileHash: '', // 可以添加文件哈希计算
+                clientID: Identity.clientID,
+                clientKey: Identity.clientKey,
+                to: this.recipients
             })
         });
 
@@ -410,6 +437,11 @@ class ResumableUploadManager {
         try {
             await Promise.all(uploadPromises);
 
+            // 服务端完成校验时发现损坏的分片，需要重新上传
+            if (uploadState.retryChunks) {
+                this.requeueChunks(uploadState, uploadState.retryChunks);
+            }
+
             // 检查是否所有分片都已完成
             console.log(`上传完成检查: ${uploadState.completedChunks.size}/${uploadState.totalChunks}, 已完成标志: ${uploadState.completed}`);
 
@@ -438,7 +470,123 @@ class ResumableUploadManager {
         } finally {
             uploadState.uploading = false;
             this.persistUploadState();
+
+            if (uploadState.retryChunks) {
+                this.requeueChunks(uploadState, uploadState.retryChunks);
+                uploadState.retryChunks = null;
+                this.uploadMissingChunks(uploadState);
+            } else if (uploadState.restartWhenIdle) {
+                // 上一轮上传结束前收到了继续上传的通知
+                uploadState.restartWhenIdle = false;
+                this.uploadMissingChunks(uploadState);
+            }
+        }
+    }
+
+    // 暂停或继续上传。暂停状态保存在服务端，会话中的所有成员都能看到并继续上传
+    async togglePause(uploadState) {
+        const action = uploadState.paused ? 'resume' : 'pause';
+        try {
+            const response = await fetch(Identity.withAuth(`/api/upload/${action}/${this.sessionID}/${encodeURIComponent(uploadState.fileName)}`), {
+                method: 'POST'
+            });
+            const result = await response.json();
+            if (!response.ok) {
+                throw new Error(result.error || '操作失败');
+            }
+            this.applyPauseState(uploadState, result.paused);
+        } catch (error) {
+            console.error('暂停或继续上传失败:', error);
+            this.showError(uploadState, error.message);
+        }
+    }
+
+    // 应用服务端的暂停状态：暂停时停止上传新的分片，继续时上传剩余的分片
+    applyPauseState(uploadState, paused) {
+        uploadState.paused = paused;
+        if (!paused && uploadState.file && !uploadState.completed) {
+            if (uploadState.uploading) {
+                uploadState.restartWhenIdle = true;
+            } else {
+                this.uploadMissingChunks(uploadState);
+            }
+        }
+        this.updateProgressUI(uploadState);
+        this.persistUploadState();
+    }
+
+    // 取消上传，服务端删除已上传的数据并通知会话中的其他成员
+    async cancelUpload(uploadState) {
+        if (!confirm(`确定取消上传 "${uploadState.fileName}" 吗？已上传的数据将被删除`)) {
+            return;
+        }
+        try {
+            const response = await fetch(Identity.withAuth(`/api/upload/${this.sessionID}/${encodeURIComponent(uploadState.fileName)}`), {
+                method: 'DELETE'
+            });
+            const result = await response.json();
+            if (!response.ok && response.status !== 404) {
+                throw new Error(result.error || '取消上传失败');
+            }
+            this.onUploadCancelled(uploadState);
+        } catch (error) {
+            console.error('取消上传失败:', error);
+            this.showError(uploadState, error.message);
+        }
+    }
+
+    // 上传已被取消（自己或会话中的其他成员），停止上传并移除上传记录
+    onUploadCancelled(uploadState) {
+        uploadState.cancelled = true;
+        uploadState.uploading = false;
+        this.uploads.delete(uploadState.fileId);
+        this.persistUploadState();
+
+        const uploadItem = document.getElementById(`upload-${uploadState.fileId}`);
+        if (uploadItem) {
+            uploadItem.remove();
+        }
+        console.log(`上传已取消: ${uploadState.fileName}`);
+    }
+
+    // 处理会话成员暂停、继续或取消上传的通知
+    handleControlMessage(message) {
+        for (const uploadState of this.uploads.values()) {
+            if (uploadState.fileName !== message.name) {
+                continue;
+            }
+            if (message.type === 'upload_cancelled') {
+                this.onUploadCancelled(uploadState);
+            } else {
+                this.applyPauseState(uploadState, message.type === 'upload_paused');
+            }
+        }
+    }
+
+    // 将服务端校验失败的分片重新加入上传队列
+    requeueChunks(uploadState, chunkIndexes) {
+        console.warn(`分片校验失败，重新上传: ${chunkIndexes.join(', ')}`);
+        for (const chunkIndex of chunkIndexes) {
+            uploadState.completedChunks.delete(chunkIndex);
+        }
+        uploadState.missingChunks = chunkIndexes;
+        uploadState.completed = false;
+        uploadState.serverCompleted = false;
+        this.updateProgressUI(uploadState);
+    }
+
+    // 计算分片的SHA-256摘要，浏览器不支持（非安全上下文）时返回null，由服务端自行记录哈希
+    async calculateChunkDigest(chunk) {
+        if (!window.crypto || !window.crypto.subtle) {
+            return null;
         }
+
+        const buffer = await chunk.arrayBuffer();
+        const digest = await window.crypto.subtle.digest('SHA-256', buffer);
+        const hex = Array.from(new Uint8Array(digest))
+            .map(b => b.toString(16).padStart(2, '0'))
+            .join('');
+        return `sha256=${hex}`;
     }
 
     // 上传单个分片
@@ -448,14 +596,20 @@ class ResumableUploadManager {
             return;
         }
 
-        const start = chunkIndex * this.chunkSize;
-        const end = Math.min(start + this.chunkSize, uploadState.file.size);
+        const chunkSize = uploadState.chunkSize || this.chunkSize;
+        const start = chunkIndex * chunkSize;
+        const end = Math.min(start + chunkSize, uploadState.file.size);
         const chunk = uploadState.file.slice(start, end);
 
         let retries = 0;
         const maxRetries = this.maxRetries;
 
         while (retries < maxRetries) {
+            // 上传已暂停或取消时不再上传剩余的分片
+            if (uploadState.paused || uploadState.cancelled) {
+                return;
+            }
+
             try {
                 const startTime = Date.now();
 
@@ -477,6 +631,9 @@ class ResumableUploadManager {
 
                 return;
             } catch (error) {
+                if (uploadState.paused || uploadState.cancelled) {
+                    return;
+                }
                 retries++;
                 console.error(`分片 ${chunkIndex} 上传失败 (重试 ${retries}/${maxRetries}):`, error);
 
@@ -498,20 +655,22 @@ class ResumableUploadManager {
             const reader = new FileReader();
 
             reader.onload = (e) => {
+                // 以二进制帧发送：一行JSON头部后紧跟原始文件数据
                 const message = {
                     type: 'file_chunk',
                     name: uploadState.file.name,
                     size: uploadState.file.size,
-                    data: Array.from(new Uint8Array(e.target.result)),
                     sessionID: this.sessionID,
                     timestamp: new Date(),
                     totalChunks: uploadState.totalChunks,
+                    chunkSize: uploadState.chunkSize || this.chunkSize,
+                    fileHash: uploadState.fileHash,
                     currentChunk: chunkIndex,
                     isLastChunk: chunkIndex === uploadState.totalChunks - 1
                 };
 
                 try {
-                    this.webSocket.send(JSON.stringify(message));
+                    this.webSocket.send(new Blob([JSON.stringify(message) + '\n', e.target.result]));
                     resolve();
                 } catch (error) {
                     reject(error);
@@ -526,28 +685,43 @@ class ResumableUploadManager {
         });
     }
 
-    // 通过HTTP API上传分片
+    // 通过HTTP API上传分片，分片数据作为原始请求体发送，服务端边接收边写入磁盘
     async uploadChunkViaAPI(uploadState, chunkIndex, chunk) {
-        const formData = new FormData();
-        formData.append('sessionID', this.sessionID);
-        formData.append('fileName', uploadState.fileName);
-        formData.append('chunkIndex', chunkIndex.toString());
-        formData.append('uploadID', uploadState.uploadID);
-        formData.append('chunk', chunk);
-
-        const response = await fetch('/api/upload/chunk', {
+        const params = new URLSearchParams({
+            sessionID: this.sessionID,
+            fileName: uploadState.fileName,
+            chunkIndex: chunkIndex.toString(),
+            uploadID: uploadState.uploadID
+        });
+
+        const headers = { 'Content-Type': 'application/octet-stream' };
+        const digest = await this.calculateChunkDigest(chunk);
+        if (digest) {
+            headers['X-Chunk-Digest'] = digest;
+        }
+
+        const response = await fetch(`/api/upload/chunk?${params.toString()}`, {
             method: 'POST',
-            body: formData
+            headers: headers,
+            body: chunk
         });
 
         const result = await response.json();
 
+        if (response.status === 423 && result.paused) {
+            // 会话中有成员暂停了上传
+            uploadState.paused = true;
+        }
         if (!response.ok) {
             throw new Error(result.error || '分片上传失败');
         }
 
         uploadState.progress = result.progress || 0;
 
+        if (result.missingChunks && result.missingChunks.length > 0) {
+            uploadState.retryChunks = result.missingChunks;
+        }
+
         // 检查是否完成
         if (result.completed) {
             // 服务端已经处理了完成逻辑，标记为已完成
@@ -572,6 +746,9 @@ class ResumableUploadManager {
             if (response.ok) {
                 this.onUploadComplete(uploadState);
                 console.log(`文件上传完成: ${uploadState.fileName}`);
+            } else if (result.retryable && result.missingChunks && result.missingChunks.length > 0) {
+                // 完成前的重新校验发现损坏分片，上传结束后重新上传这些分片
+                uploadState.retryChunks = result.missingChunks;
             } else {
                 throw new Error(result.error || '完成上传失败');
             }
@@ -631,7 +808,11 @@ class ResumableUploadManager {
             <div class="progress-display">
                 <div class="progress-bar" id="progress-bar-${uploadState.fileId}" style="width: 0%"></div>
             </div>
+            <button class="file-action" id="pause-${uploadState.fileId}">暂停</button>
+            <button class="file-action" id="cancel-${uploadState.fileId}">取消</button>
         `;
+        progressElement.querySelector(`#pause-${uploadState.fileId}`).addEventListener('click', () => this.togglePause(uploadState));
+        progressElement.querySelector(`#cancel-${uploadState.fileId}`).addEventListener('click', () => this.cancelUpload(uploadState));
 
         progressContainer.prepend(progressElement);
     }
@@ -656,8 +837,15 @@ class ResumableUploadManager {
             progressText.textContent = `${currentProgress.toFixed(1)}%`;
         }
 
+        const pauseButton = document.getElementById(`pause-${uploadState.fileId}`);
+        if (pauseButton) {
+            pauseButton.textContent = uploadState.paused ? '继续' : '暂停';
+        }
+
         if (statusText) {
-            if (uploadState.uploading) {
+            if (uploadState.paused) {
+                statusText.textContent = '已暂停';
+            } else if (uploadState.uploading) {
                 statusText.textContent = `上传中... (${uploadState.completedChunks.size}/${uploadState.totalChunks} 分片)`;
             } else if (currentProgress >= 100) {
                 statusText.textContent = '已完成';
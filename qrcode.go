@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// 二维码默认尺寸和允许的尺寸范围（像素）
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 1024
+)
+
+// 获取对外访问的基础URL（协议 + 主机），优先使用配置，其次使用可信反向代理的转发头，最后使用请求本身。
+// 任何客户端都可以伪造X-Forwarded-*头，只有请求来自 -trusted-proxies 中的地址时才使用
+func externalBaseURL(c *gin.Context) string {
+	trusted := fromTrustedProxy(c)
+
+	scheme := serverConfig.ExternalScheme
+	if scheme == "" {
+		if proto := c.GetHeader("X-Forwarded-Proto"); trusted && proto != "" {
+			scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+		} else if c.Request.TLS != nil {
+			scheme = "https"
+		} else {
+			scheme = "http"
+		}
+	}
+
+	host := serverConfig.ExternalHost
+	if host == "" {
+		if forwardedHost := c.GetHeader("X-Forwarded-Host"); trusted && forwardedHost != "" {
+			host = strings.TrimSpace(strings.Split(forwardedHost, ",")[0])
+		} else {
+			host = c.Request.Host
+		}
+	}
+
+	return scheme + "://" + host
+}
+
+// 请求是否直接来自可信的反向代理
+func fromTrustedProxy(c *gin.Context) bool {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && serverConfig.TrustedProxies.contains(ip)
+}
+
+// 获取会话的完整共享链接，type 参数决定是文字页面还是文件页面
+func sessionShareURL(c *gin.Context, sessionID string) (string, error) {
+	pageType := c.DefaultQuery("type", "file")
+	if pageType != "file" && pageType != "text" {
+		return "", fmt.Errorf("不支持的页面类型: %s", pageType)
+	}
+	return externalBaseURL(c) + "/" + pageType + "/" + sessionID, nil
+}
+
+// 解析二维码尺寸参数
+func qrSizeParam(c *gin.Context) int {
+	size, err := strconv.Atoi(c.DefaultQuery("size", strconv.Itoa(defaultQRSize)))
+	if err != nil {
+		return defaultQRSize
+	}
+	if size < minQRSize {
+		return minQRSize
+	}
+	if size > maxQRSize {
+		return maxQRSize
+	}
+	return size
+}
+
+// 获取会话链接二维码（PNG）
+func getSessionQRCodePNG(c *gin.Context) {
+	sessionID := c.Param("sessionID")
+
+	shareURL, err := sessionShareURL(c, sessionID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	png, err := qrcode.Encode(shareURL, qrcode.Medium, qrSizeParam(c))
+	if err != nil {
+		log.Printf("生成二维码失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成二维码失败"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// 获取会话链接二维码（SVG）
+func getSessionQRCodeSVG(c *gin.Context) {
+	sessionID := c.Param("sessionID")
+
+	shareURL, err := sessionShareURL(c, sessionID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	qr, err := qrcode.New(shareURL, qrcode.Medium)
+	if err != nil {
+		log.Printf("生成二维码失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成二维码失败"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "image/svg+xml", renderQRCodeSVG(qr.Bitmap(), qrSizeParam(c)))
+}
+
+// 将二维码位图渲染为SVG，每个深色模块对应路径中的一个单位方块
+func renderQRCodeSVG(bitmap [][]bool, size int) []byte {
+	modules := len(bitmap)
+
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, modules, modules)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="#fff"/>`, modules, modules)
+	fmt.Fprintf(&svg, `<path fill="#000" d="%s"/>`, path.String())
+	svg.WriteString(`</svg>`)
+	return []byte(svg.String())
+}
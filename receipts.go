@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 每个文件保留的下载记录数量，超过后丢弃最早的记录（下载次数仍然累计）
+const maxDownloadRecords = 100
+
+// 一次完整的下载：只有整个文件内容都写入响应后才会记录
+type DownloadRecord struct {
+	Client      *ClientInfo `json:"client,omitempty"` // 通过clientID和clientKey识别的下载方，匿名下载时为空
+	RemoteAddr  string      `json:"remoteAddr"`
+	Bytes       int64       `json:"bytes"`
+	Streamed    bool        `json:"streamed,omitempty"` // 边传边下
+	CompletedAt time.Time   `json:"completedAt"`
+}
+
+// 根据请求生成下载记录，调用方需持有会话锁
+func newDownloadRecord(c *gin.Context, session *Session, bytes int64, streamed bool) DownloadRecord {
+	record := DownloadRecord{
+		RemoteAddr:  c.ClientIP(),
+		Bytes:       bytes,
+		Streamed:    streamed,
+		CompletedAt: time.Now(),
+	}
+	if clientID := requestClientID(c, session); clientID != "" {
+		if info, ok := session.clientInfo(clientID); ok {
+			record.Client = &info
+		} else {
+			record.Client = &ClientInfo{ID: clientID}
+		}
+	}
+	return record
+}
+
+// 响应是否完整发送了文件内容：HEAD请求和范围请求不算完整下载。
+// size为磁盘上文件的大小；没有写入响应体时Writer.Size()为-1，空文件按写入0字节计算
+func downloadCompleted(c *gin.Context, size int64) bool {
+	written := int64(c.Writer.Size())
+	if written < 0 {
+		written = 0
+	}
+	return c.Request.Method == http.MethodGet &&
+		c.Writer.Status() == http.StatusOK &&
+		written == size
+}
+
+// 记录一次完整的下载，并通知上传者
+func recordDownload(c *gin.Context, sessionID, fileName string, bytes int64, streamed bool) {
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	fileInfo, exists := session.ReceivedFiles[fileName]
+	if !exists {
+		return
+	}
+
+	record := newDownloadRecord(c, session, bytes, streamed)
+	fileInfo.DownloadCount++
+	fileInfo.Downloads = append(fileInfo.Downloads, record)
+	if len(fileInfo.Downloads) > maxDownloadRecords {
+		fileInfo.Downloads = fileInfo.Downloads[len(fileInfo.Downloads)-maxDownloadRecords:]
+	}
+	log.Printf("文件 %s 已被完整下载，累计 %d 次", fileName, fileInfo.DownloadCount)
+	session.saveFileMeta(fileInfo)
+
+	notifyUploader(session, fileInfo, record)
+}
+
+// 向上传者的所有连接发送下载回执，未记录上传者时不发送。调用方需持有会话锁
+func notifyUploader(session *Session, fileInfo *FileInfo, record DownloadRecord) {
+	uploaderID := fileInfo.uploaderID()
+	if uploaderID == "" {
+		return
+	}
+
+	message := Message{
+		Type:      "file_downloaded",
+		Name:      fileInfo.Name,
+		Size:      fileInfo.Size,
+		SessionID: session.ID,
+		Timestamp: time.Now(),
+		Data: gin.H{
+			"download":      record,
+			"downloadCount": fileInfo.DownloadCount,
+		},
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println("marshal failed:", err)
+		return
+	}
+	fanOut(newOutboundMessage(message, data), session, []string{uploaderID}, "")
+}
+
+// 复制文件信息，供会话锁之外序列化使用
+func (f *FileInfo) snapshot() *FileInfo {
+	copied := *f
+	copied.Downloads = append([]DownloadRecord(nil), f.Downloads...)
+	return &copied
+}
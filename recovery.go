@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 启动时扫描配置目录，根据断点续传配置重建会话和未完成的上传。
+// 分片数据同步到磁盘后才会记录到日志，因此直接信任日志中已完成的分片，不在启动时重新计算哈希；
+// 完成上传时会按记录的哈希校验所有分片，损坏的分片在那时重新标记为未完成
+func recoverResumableUploads() {
+	entries, err := os.ReadDir(ConfigDir)
+	if err != nil {
+		log.Printf("读取配置目录失败: %v", err)
+		return
+	}
+
+	start := time.Now()
+	recovered := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		configPath := filepath.Join(ConfigDir, entry.Name())
+		if recoverResumableUpload(configPath) {
+			recovered++
+		}
+	}
+
+	if recovered > 0 {
+		log.Printf("已恢复 %d 个未完成的上传，耗时 %s", recovered, time.Since(start))
+	}
+}
+
+// 恢复单个断点续传配置，无法恢复的配置保持原样，由定期清理处理
+func recoverResumableUpload(configPath string) bool {
+	configLock := resumableConfigLock(configPath)
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	config, err := loadResumableConfig(configPath)
+	if err != nil {
+		log.Printf("加载配置文件失败 %s: %v", configPath, err)
+		return false
+	}
+	if config.ownedByOtherNode() {
+		// 由其他节点恢复，本节点不校验也不修改
+		return false
+	}
+
+	sessionID := config.SessionID
+	if sessionID == "" {
+		sessionID = extractSessionIDFromFileName(filepath.Base(configPath))
+	}
+	fileName, err := normalizeUploadTarget(sessionID, config.FileName)
+	if err != nil || resumableConfigPath(sessionID, fileName) != configPath {
+		log.Printf("配置文件与会话或文件名不符，跳过: %s", configPath)
+		return false
+	}
+
+	// 不信任配置中记录的路径，按会话ID和文件名重新计算
+	config.SessionID = sessionID
+	config.FileName = fileName
+	config.TempFilePath = storagePath(sessionID, fileName)
+
+	if err := ensureUploadTempFile(config); err != nil {
+		log.Printf("准备临时文件失败 %s: %v", config.TempFilePath, err)
+		return false
+	}
+
+	config.UpdatedAt = time.Now()
+	if err := saveResumableConfig(configPath, config); err != nil {
+		log.Printf("保存配置文件失败: %v", err)
+		return false
+	}
+
+	transfers.trackPending(sessionID, fileName, configPath)
+
+	// 重启前所有分片都已写入但还没来得及完成的上传，在后台校验并完成，不推迟服务启动
+	if len(missingChunks(config)) == 0 {
+		go func() {
+			if _, err := transfers.Complete(sessionID, fileName); err != nil {
+				log.Printf("完成恢复的上传失败 %s: %v", fileName, err)
+			}
+		}()
+	}
+
+	log.Printf("已恢复上传: 会话 %s, 文件 %s, 进度 %.1f%%", sessionID, fileName, calculateProgress(config))
+	return true
+}
+
+// 确保临时文件存在且大小与配置一致。文件丢失时重新创建，所有分片都需要重新上传
+func ensureUploadTempFile(config *ResumableFileConfig) error {
+	info, err := os.Stat(config.TempFilePath)
+	if os.IsNotExist(err) {
+		for i := 0; i < config.TotalChunks; i++ {
+			config.resetChunk(i)
+		}
+	} else if err != nil {
+		return err
+	} else if info.Size() == config.FileSize {
+		return nil
+	}
+
+	file, err := os.OpenFile(config.TempFilePath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Truncate(config.FileSize)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 会话ID和文件名的长度限制
+const (
+	maxSessionIDLength = 64
+	maxFileNameBytes   = 255
+)
+
+// Windows保留的设备名，不区分大小写，带扩展名时同样保留
+var reservedFileNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// 校验会话ID：只允许字母、数字和连字符。下划线用作存储文件名中会话ID的分隔符，因此不允许出现
+func validateSessionID(sessionID string) error {
+	if sessionID == "" {
+		return errors.New("会话ID不能为空")
+	}
+	if len(sessionID) > maxSessionIDLength {
+		return fmt.Errorf("会话ID长度不能超过 %d", maxSessionIDLength)
+	}
+	for _, r := range sessionID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return fmt.Errorf("会话ID包含非法字符: %q", r)
+		}
+	}
+	return nil
+}
+
+// 规范化客户端提供的文件名：去掉路径部分、控制字符和非法字符，处理保留名并限制长度
+func sanitizeFileName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", errors.New("文件名不是有效的UTF-8字符串")
+	}
+
+	// 只保留最后一级路径，统一处理Windows和Unix分隔符
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsControl(r):
+			// 丢弃控制字符
+		case strings.ContainsRune(`<>:"/\|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	// Windows不允许文件名以空格或点结尾
+	name = strings.TrimRight(strings.TrimSpace(b.String()), ". ")
+	if name == "" || name == "." || name == ".." {
+		return "", errors.New("文件名无效")
+	}
+
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedFileNames[strings.ToUpper(base)] {
+		name = "_" + name
+	}
+
+	// 截断时丢弃扩展名可能在末尾留下空格或点，再次去除，使规范化后的文件名再次规范化时保持不变
+	name = strings.TrimRight(truncateFileName(name, maxFileNameBytes), ". ")
+	if name == "" {
+		return "", errors.New("文件名无效")
+	}
+	return name, nil
+}
+
+// 按字节截断文件名，尽量保留扩展名且不截断多字节字符
+func truncateFileName(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) >= limit/2 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	stem = stem[:limit-len(ext)]
+	for !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+	return stem + ext
+}
+
+// 文件在磁盘上的不透明存储键：会话ID前缀便于按会话清理，文件名部分使用哈希避免任何路径注入
+func storageKey(sessionID, fileName string) string {
+	sum := sha256.Sum256([]byte(fileName))
+	return sessionID + "_" + hex.EncodeToString(sum[:16])
+}
+
+// 文件数据的存储路径
+func storagePath(sessionID, fileName string) string {
+	return filepath.Join(TempDir, storageKey(sessionID, fileName))
+}
+
+// 断点续传配置文件路径
+func resumableConfigPath(sessionID, fileName string) string {
+	return filepath.Join(ConfigDir, storageKey(sessionID, fileName)+".json")
+}
+
+// 生成Content-Disposition头：filename为ASCII兼容的回退名，filename*按RFC 5987编码原始UTF-8文件名
+func contentDisposition(fileName string) string {
+	var fallback strings.Builder
+	for _, r := range fileName {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback.String(), encodeRFC5987(fileName))
+}
+
+// 按RFC 5987的attr-char规则进行百分号编码
+func encodeRFC5987(s string) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0x0f])
+		}
+	}
+	return b.String()
+}
+
+// 校验路由中的会话ID参数，所有带 :sessionID 的路由都经过此中间件
+func sessionIDGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if sessionID := c.Param("sessionID"); sessionID != "" {
+			if err := validateSessionID(sessionID); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// 校验会话ID并规范化文件名，供上传相关接口使用
+func normalizeUploadTarget(sessionID, fileName string) (string, error) {
+	if err := validateSessionID(sessionID); err != nil {
+		return "", err
+	}
+	return sanitizeFileName(fileName)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSessionID(t *testing.T) {
+	for _, test := range []struct {
+		sessionID string
+		valid     bool
+	}{
+		{"abc123", true},
+		{"a-B-9", true},
+		{strings.Repeat("a", maxSessionIDLength), true},
+		{"", false},
+		{strings.Repeat("a", maxSessionIDLength+1), false},
+		{"abc_123", false}, // 下划线是存储键的分隔符
+		{"../abc", false},
+		{"abc def", false},
+		{"会话", false},
+	} {
+		if err := validateSessionID(test.sessionID); (err == nil) != test.valid {
+			t.Errorf("validateSessionID(%q) = %v，期望有效: %v", test.sessionID, err, test.valid)
+		}
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		want  string // 为空表示期望返回错误
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Users\a\doc.txt`, "doc.txt"},
+		{`a<b>c:d"e|f?g*h.txt`, "a_b_c_d_e_f_g_h.txt"},
+		{"bad\x00\x1fname\x7f.txt", "badname.txt"},
+		{"  spaced.txt  ", "spaced.txt"},
+		{"name. . ", "name"},
+		{"CON", "_CON"},
+		{"con.tar.gz", "_con.tar.gz"},
+		{"CONSOLE.txt", "CONSOLE.txt"},
+		{"报告.pdf", "报告.pdf"},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"...", ""},
+		{"dir/..", ""},
+		{"\xff.txt", ""},
+
+		// 超长的文件名保留扩展名截断
+		{strings.Repeat("a", 300) + ".txt", strings.Repeat("a", maxFileNameBytes-4) + ".txt"},
+		// 不截断多字节字符
+		{strings.Repeat("文", 100) + ".txt", strings.Repeat("文", (maxFileNameBytes-4)/3) + ".txt"},
+		// 扩展名过长时丢弃扩展名
+		{"a." + strings.Repeat("b", 300), "a." + strings.Repeat("b", maxFileNameBytes-2)},
+		// 截断后末尾的空格和点被去除
+		{strings.Repeat("a", maxFileNameBytes-1) + " " + strings.Repeat("b", 10), strings.Repeat("a", maxFileNameBytes-1)},
+		{strings.Repeat("a", maxFileNameBytes-2) + ".." + strings.Repeat("b", 200), strings.Repeat("a", maxFileNameBytes-2)},
+		{strings.Repeat(".", 300) + "." + strings.Repeat("b", 200), ""},
+	} {
+		got, err := sanitizeFileName(test.input)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("sanitizeFileName(%q) = %q，期望返回错误", test.input, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("sanitizeFileName(%q) = %q, %v，期望 %q", test.input, got, err, test.want)
+			continue
+		}
+
+		// 规范化后的文件名再次规范化时保持不变
+		if again, err := sanitizeFileName(got); err != nil || again != got {
+			t.Errorf("sanitizeFileName(%q) = %q, %v，再次规范化后发生变化", got, again, err)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"a.txt", `attachment; filename="a.txt"; filename*=UTF-8''a.txt`},
+		{"报告.pdf", `attachment; filename="__.pdf"; filename*=UTF-8''%E6%8A%A5%E5%91%8A.pdf`},
+		{"a b;c.txt", `attachment; filename="a b;c.txt"; filename*=UTF-8''a%20b%3Bc.txt`},
+		{`a"b\c.txt`, `attachment; filename="a_b_c.txt"; filename*=UTF-8''a%22b%5Cc.txt`},
+	} {
+		if got := contentDisposition(test.name); got != test.want {
+			t.Errorf("contentDisposition(%q) = %s，期望 %s", test.name, got, test.want)
+		}
+	}
+}
+
+// 存储键不包含文件名，只由会话ID前缀和哈希组成
+func TestStorageKey(t *testing.T) {
+	key := storageKey("abc123", "../../etc/passwd")
+	if !strings.HasPrefix(key, "abc123_") || len(key) != len("abc123_")+32 || strings.ContainsAny(key, "./\\") {
+		t.Fatalf("存储键 %q 不是不透明的", key)
+	}
+	if storageKey("abc123", "a.txt") == storageKey("abc123", "b.txt") {
+		t.Fatal("不同文件名的存储键相同")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 重命名/移动文件请求
+type FileRenameRequest struct {
+	NewName         string `json:"newName"`         // 新文件名，为空时保持原名
+	TargetSessionID string `json:"targetSessionID"` // 目标会话ID，为空时在当前会话内重命名
+}
+
+// 未完成的上传
+type PendingUpload struct {
+	Name          string  `json:"name"`
+	Size          int64   `json:"size"`
+	Progress      float64 `json:"progress"`
+	MissingChunks int     `json:"missingChunks"`
+	Paused        bool    `json:"paused"`
+}
+
+// 获取会话中已接收的文件列表和未完成的上传。定向传输的文件只对通过clientID和clientKey识别的接收方和上传者可见
+func listSessionFiles(c *gin.Context) {
+	sessionID := c.Param("sessionID")
+
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.RLock()
+	clientID := requestClientID(c, session)
+	files := make([]*FileInfo, 0, len(session.ReceivedFiles))
+	for _, fileInfo := range session.ReceivedFiles {
+		if fileInfo.accessibleBy(clientID) {
+			files = append(files, fileInfo.snapshot())
+		}
+	}
+	pendingConfigs := make(map[string]string, len(session.PendingUploads))
+	for name, configPath := range session.PendingUploads {
+		pendingConfigs[name] = configPath
+	}
+	session.mu.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	// 未完成的断点续传，进度从配置文件读取
+	uploads := make([]PendingUpload, 0, len(pendingConfigs))
+	for name, configPath := range pendingConfigs {
+		configLock := resumableConfigLock(configPath)
+		configLock.RLock()
+		config, err := loadResumableConfig(configPath)
+		if err != nil || !config.fileInfo().accessibleBy(clientID) {
+			configLock.RUnlock()
+			continue
+		}
+		uploads = append(uploads, PendingUpload{
+			Name:          name,
+			Size:          config.FileSize,
+			Progress:      calculateProgress(config),
+			MissingChunks: config.TotalChunks - config.completedChunks(),
+			Paused:        config.Paused,
+		})
+		configLock.RUnlock()
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Name < uploads[j].Name
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"sessionID": sessionID,
+		"files":     files,
+		"uploads":   uploads,
+	})
+}
+
+// 删除会话中的文件
+func deleteSessionFile(c *gin.Context) {
+	sessionID := c.Param("sessionID")
+	name, err := sanitizeFileName(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	fileInfo, exists := session.ReceivedFiles[name]
+	if !exists || !fileInfo.accessibleBy(requestClientID(c, session)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+		return
+	}
+
+	if err := removeStoredFile(fileInfo.TempFilePath); err != nil {
+		log.Printf("删除文件失败 %s: %v", fileInfo.TempFilePath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除文件失败"})
+		return
+	}
+
+	delete(session.ReceivedFiles, name)
+	if session.FileInfo != nil && session.FileInfo.Name == name {
+		session.FileInfo = nil
+	}
+	session.deleteMeta(metaPrefixFile + name)
+	log.Printf("已从会话 %s 删除文件: %s", sessionID, name)
+
+	broadcastToRecipients(Message{
+		Type:      "file_deleted",
+		Name:      name,
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+	}, session, fileInfo.Recipients, fileInfo.uploaderID())
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "文件已删除",
+		"fileName": name,
+	})
+}
+
+// 重命名会话中的文件，或将其移动到另一个会话
+func renameSessionFile(c *gin.Context) {
+	sessionID := c.Param("sessionID")
+	name := c.Param("name")
+
+	var req FileRenameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, err := sanitizeFileName(name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	newName := req.NewName
+	if newName == "" {
+		newName = name
+	}
+	targetSessionID := req.TargetSessionID
+	if targetSessionID == "" {
+		targetSessionID = sessionID
+	}
+	newName, err = normalizeUploadTarget(targetSessionID, newName)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if newName == name && targetSessionID == sessionID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "新文件名与原文件名相同"})
+		return
+	}
+
+	// 持有目标文件名的上传配置锁，期间不会开始同名的上传
+	configPath := resumableConfigPath(targetSessionID, newName)
+	configLock := resumableConfigLock(configPath)
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	source := store.GetOrCreateSession(sessionID)
+	target := store.GetOrCreateSession(targetSessionID)
+
+	// 按会话ID顺序加锁，避免两个方向的移动互相死锁
+	unlock := lockSessionPair(source, target)
+	defer unlock()
+
+	fileInfo, exists := source.ReceivedFiles[name]
+	if !exists || !fileInfo.accessibleBy(requestClientID(c, source)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+		return
+	}
+	if _, exists := target.ReceivedFiles[newName]; exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "目标文件名已存在"})
+		return
+	}
+	// 目标文件名有进行中的上传时，重命名会覆盖它的临时文件
+	_, pending := target.PendingUploads[newName]
+	if _, err := os.Stat(configPath); pending || err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "目标文件名正在上传"})
+		return
+	}
+
+	newPath := storagePath(targetSessionID, newName)
+	if err := os.Rename(fileInfo.TempFilePath, newPath); err != nil {
+		log.Printf("重命名文件失败 %s -> %s: %v", fileInfo.TempFilePath, newPath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "重命名文件失败"})
+		return
+	}
+
+	contents.move(fileInfo.TempFilePath, newPath)
+
+	delete(source.ReceivedFiles, name)
+	if source.FileInfo != nil && source.FileInfo.Name == name {
+		source.FileInfo = nil
+	}
+	fileInfo.Name = newName
+	fileInfo.TempFilePath = newPath
+	target.ReceivedFiles[newName] = fileInfo
+	source.deleteMeta(metaPrefixFile + name)
+	target.saveFileMeta(fileInfo)
+	log.Printf("文件已重命名: %s/%s -> %s/%s", sessionID, name, targetSessionID, newName)
+
+	// 定向传输的文件仍只通知接收方和上传者
+	recipients, senderID := fileInfo.Recipients, fileInfo.uploaderID()
+	if targetSessionID == sessionID {
+		broadcastToRecipients(Message{
+			Type:      "file_renamed",
+			Name:      newName,
+			Size:      fileInfo.Size,
+			SessionID: sessionID,
+			Timestamp: time.Now(),
+			Data:      gin.H{"oldName": name},
+		}, source, recipients, senderID)
+	} else {
+		// 移动到其他会话：源会话视为删除，目标会话视为新文件
+		broadcastToRecipients(Message{
+			Type:      "file_deleted",
+			Name:      name,
+			SessionID: sessionID,
+			Timestamp: time.Now(),
+			Data:      gin.H{"movedTo": targetSessionID},
+		}, source, recipients, senderID)
+		broadcastToRecipients(Message{
+			Type:      "file",
+			Name:      newName,
+			Size:      fileInfo.Size,
+			SessionID: targetSessionID,
+			Timestamp: time.Now(),
+			Stored:    true,
+			Data:      "文件已保存在服务器上，可通过下载链接获取",
+			From:      fileInfo.UploadedBy,
+			To:        recipients,
+		}, target, recipients, senderID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "文件已重命名",
+		"fileName":  newName,
+		"sessionID": targetSessionID,
+	})
+}
+
+// 同时锁定两个会话，返回解锁函数
+func lockSessionPair(a, b *Session) func() {
+	if a == b {
+		a.mu.Lock()
+		return a.mu.Unlock
+	}
+	if a.ID > b.ID {
+		a, b = b, a
+	}
+	a.mu.Lock()
+	b.mu.Lock()
+	return func() {
+		b.mu.Unlock()
+		a.mu.Unlock()
+	}
+}
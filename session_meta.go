@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// 会话元数据字段前缀
+const (
+	metaFieldText    = "text"
+	metaPrefixFile   = "file:"
+	metaPrefixUpload = "pending:"
+	metaPrefixKey    = "key:"
+	metaPrefixRoster = "roster:"
+)
+
+// 文字内容元数据
+type textMeta struct {
+	Content string      `json:"content"`
+	Author  *ClientInfo `json:"author,omitempty"`
+}
+
+// 更新会话元数据字段：写入共享存储并通知其他节点。调用方需持有会话锁
+func (s *Session) setMeta(field string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("序列化会话元数据失败 %s: %v", field, err)
+		return
+	}
+	cluster.enqueue(busEvent{
+		SessionID: s.ID,
+		Kind:      busEventMeta,
+		Field:     field,
+		Data:      data,
+	})
+}
+
+// 删除会话元数据字段。调用方需持有会话锁
+func (s *Session) deleteMeta(field string) {
+	cluster.enqueue(busEvent{
+		SessionID: s.ID,
+		Kind:      busEventMeta,
+		Field:     field,
+		Deleted:   true,
+	})
+}
+
+// 删除会话的所有元数据，会话在所有节点上都没有客户端并已清理时调用。调用方需持有会话锁
+func (s *Session) dropMeta() {
+	cluster.enqueue(busEvent{
+		SessionID: s.ID,
+		Kind:      busEventMeta,
+		Deleted:   true,
+	})
+}
+
+// 保存文件信息元数据。调用方需持有会话锁
+func (s *Session) saveFileMeta(fileInfo *FileInfo) {
+	s.setMeta(metaPrefixFile+fileInfo.Name, fileInfo)
+}
+
+// 保存本节点的在线列表，本节点没有客户端时删除。调用方需持有会话锁
+func (s *Session) saveRosterMeta() {
+	field := metaPrefixRoster + cluster.nodeID
+	roster := s.localRoster()
+	if len(roster) == 0 {
+		s.deleteMeta(field)
+		return
+	}
+	s.setMeta(field, roster)
+}
+
+// 应用其他节点的元数据变化或从共享存储加载的元数据。调用方需持有会话锁
+func (s *Session) applyMeta(field string, data []byte, deleted bool) {
+	var err error
+	switch {
+	case field == "":
+		// 会话的元数据已被清理，其他节点上的在线列表随之失效
+		s.RemoteRosters = make(map[string][]ClientInfo)
+
+	case field == metaFieldText:
+		var text textMeta
+		if !deleted {
+			err = json.Unmarshal(data, &text)
+		}
+		s.TextContent = text.Content
+		s.TextAuthor = text.Author
+
+	case strings.HasPrefix(field, metaPrefixFile):
+		name := strings.TrimPrefix(field, metaPrefixFile)
+		if deleted {
+			delete(s.ReceivedFiles, name)
+			break
+		}
+		var fileInfo FileInfo
+		if err = json.Unmarshal(data, &fileInfo); err == nil {
+			// 存储路径不随文件信息共享，由会话ID和文件名确定
+			fileInfo.TempFilePath = storagePath(s.ID, name)
+			s.ReceivedFiles[name] = &fileInfo
+			delete(s.PendingUploads, name)
+		}
+
+	case strings.HasPrefix(field, metaPrefixUpload):
+		name := strings.TrimPrefix(field, metaPrefixUpload)
+		if deleted {
+			delete(s.PendingUploads, name)
+			break
+		}
+		var configPath string
+		if err = json.Unmarshal(data, &configPath); err == nil {
+			s.PendingUploads[name] = configPath
+		}
+
+	case strings.HasPrefix(field, metaPrefixKey):
+		clientID := strings.TrimPrefix(field, metaPrefixKey)
+		if deleted {
+			delete(s.ClientKeys, clientID)
+			break
+		}
+		var key string
+		if err = json.Unmarshal(data, &key); err == nil {
+			s.ClientKeys[clientID] = key
+		}
+
+	case strings.HasPrefix(field, metaPrefixRoster):
+		node := strings.TrimPrefix(field, metaPrefixRoster)
+		if node == cluster.nodeID {
+			break
+		}
+		if deleted {
+			delete(s.RemoteRosters, node)
+			break
+		}
+		var roster []ClientInfo
+		if err = json.Unmarshal(data, &roster); err == nil {
+			s.RemoteRosters[node] = roster
+		}
+	}
+
+	if err != nil {
+		log.Printf("解析会话元数据失败 %s/%s: %v", s.ID, field, err)
+	}
+}
+
+// 从共享存储加载会话元数据，新建会话时调用
+func (s *Session) loadMeta() {
+	fields, err := cluster.meta.Load(s.ID)
+	if err != nil {
+		log.Printf("加载会话元数据失败 %s: %v", s.ID, err)
+		return
+	}
+	for field, data := range fields {
+		s.applyMeta(field, data, false)
+	}
+	if len(fields) > 0 {
+		log.Printf("已从共享存储加载会话 %s 的 %d 项元数据", s.ID, len(fields))
+	}
+}
+
+// 其他节点上是否还有该会话的客户端。调用方需持有会话锁
+func (s *Session) hasRemoteClients() bool {
+	for _, roster := range s.RemoteRosters {
+		if len(roster) > 0 {
+			return true
+		}
+	}
+	return false
+}
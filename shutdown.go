@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 进行中活动的跟踪器，关闭服务时停止接受新的活动并等待已有活动完成
+type activityTracker struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+	idle     chan struct{}
+}
+
+// 进行中的分片写入（包括Sync）
+var uploadWrites = &activityTracker{}
+
+// 已建立的WebSocket连接
+var wsConnections = &activityTracker{}
+
+// 开始一次活动，服务关闭中时返回false
+func (t *activityTracker) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return false
+	}
+	t.active++
+	return true
+}
+
+// 结束一次活动
+func (t *activityTracker) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active--
+	if t.active == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// 是否正在关闭
+func (t *activityTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// 停止接受新的活动
+func (t *activityTracker) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+}
+
+// 等待进行中的活动完成或超时
+func (t *activityTracker) wait(ctx context.Context) error {
+	t.mu.Lock()
+	if t.active == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	active := t.active
+	t.mu.Unlock()
+
+	log.Printf("等待 %d 个进行中的活动完成", active)
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 服务关闭中时拒绝新的会话和上传请求
+func rejectWhileDraining(c *gin.Context) bool {
+	if !uploadWrites.isDraining() {
+		return false
+	}
+	respondDraining(c)
+	return true
+}
+
+// 返回服务关闭中的可重试错误
+func respondDraining(c *gin.Context) {
+	c.Header("Retry-After", strconv.Itoa(int(serverConfig.ReconnectDelay.Seconds())))
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":     "服务器正在关闭，请稍后重试",
+		"retryable": true,
+	})
+}
+
+// 通知所有WebSocket客户端服务器即将关闭，并附带重连提示
+func broadcastServerShutdown() {
+	store.mu.RLock()
+	sessions := make([]*Session, 0, len(store.sessions))
+	for _, session := range store.sessions {
+		sessions = append(sessions, session)
+	}
+	store.mu.RUnlock()
+
+	for _, session := range sessions {
+		message := Message{
+			Type:      "server_shutdown",
+			Content:   "服务器正在关闭，请稍后重新连接",
+			SessionID: session.ID,
+			Timestamp: time.Now(),
+			Data: gin.H{
+				"reconnectAfter": int(serverConfig.ReconnectDelay.Seconds()),
+			},
+		}
+		data, err := json.Marshal(message)
+		if err != nil {
+			continue
+		}
+
+		// 只通知连接到本节点的客户端，其他节点上的客户端不受影响
+		session.mu.Lock()
+		if len(session.Clients) > 0 {
+			deliverMessage(newOutboundMessage(message, data), session, nil, "")
+		}
+		session.mu.Unlock()
+	}
+}
+
+// 关闭所有WebSocket客户端的发送队列，writePump发送完队列中的消息后发送关闭帧并断开连接
+func closeAllWebSockets(ctx context.Context) {
+	wsConnections.stop()
+
+	store.mu.RLock()
+	for _, session := range store.sessions {
+		session.mu.Lock()
+		if len(session.Clients) > 0 {
+			for client := range session.Clients {
+				delete(session.Clients, client)
+				client.out.close()
+			}
+			// 通知其他节点本节点的客户端已全部离开
+			broadcastPresence(session, "sync", ClientInfo{})
+		}
+		session.mu.Unlock()
+	}
+	store.mu.RUnlock()
+
+	if err := wsConnections.wait(ctx); err != nil {
+		log.Printf("等待WebSocket连接关闭超时: %v", err)
+	}
+}
+
+// 优雅关闭：停止接受新会话，通知客户端，等待进行中的分片写入后关闭服务
+func gracefulShutdown(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout)
+	defer cancel()
+
+	log.Printf("开始优雅关闭，最长等待 %s", serverConfig.ShutdownTimeout)
+
+	// 标记为关闭中后，新的会话、上传和分片请求都会被拒绝
+	uploadWrites.stop()
+	broadcastServerShutdown()
+
+	if err := uploadWrites.wait(ctx); err != nil {
+		log.Printf("等待分片写入超时: %v", err)
+	} else {
+		log.Println("所有进行中的分片写入已完成")
+	}
+
+	// 中断边传边下，先断开WebSocket（已被劫持的连接不受Shutdown管理），再关闭HTTP服务
+	transfers.abortAllProgress()
+	closeAllWebSockets(ctx)
+	if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("关闭HTTP服务失败: %v", err)
+	}
+	cluster.close()
+
+	log.Println("服务器已关闭")
+}
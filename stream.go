@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 边传边下时检查上传是否仍然存在的间隔
+const streamCheckInterval = 15 * time.Second
+
+// 进行中传输的状态
+const (
+	transferActive = iota
+	transferDone
+	transferAborted
+)
+
+// 进行中传输的可下载进度：从文件开头起连续完成的字节数。每次更新都会关闭changed通道唤醒等待的下载
+type transferProgress struct {
+	mu      sync.Mutex
+	ready   int64
+	size    int64
+	state   int
+	changed chan struct{}
+}
+
+func newTransferProgress(size int64) *transferProgress {
+	return &transferProgress{size: size, changed: make(chan struct{})}
+}
+
+// 获取当前进度和用于等待下一次更新的通道
+func (p *transferProgress) snapshot() (int64, int, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ready, p.state, p.changed
+}
+
+// 更新进度并唤醒等待的下载
+func (p *transferProgress) update(ready int64, state int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state != transferActive {
+		return
+	}
+	p.ready = ready
+	p.state = state
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// 获取传输的进度记录，不存在时根据配置文件创建。调用方需持有配置文件锁
+func (e *TransferEngine) progressLocked(configPath string, config *ResumableFileConfig) *transferProgress {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	progress, exists := e.progress[configPath]
+	if !exists {
+		progress = newTransferProgress(config.FileSize)
+		progress.ready = config.contiguousBytes()
+		e.progress[configPath] = progress
+	}
+	return progress
+}
+
+// 分片写入后更新可下载进度
+func (e *TransferEngine) notifyProgress(configPath string, config *ResumableFileConfig) {
+	e.progressLocked(configPath, config).update(config.contiguousBytes(), transferActive)
+}
+
+// 传输结束（完成或失败）时唤醒所有等待的下载并移除进度记录和速度统计
+func (e *TransferEngine) finishProgress(configPath string, state int) {
+	e.mu.Lock()
+	progress, exists := e.progress[configPath]
+	delete(e.progress, configPath)
+	delete(e.stats, configPath)
+	e.retireUploadFileLocked(configPath)
+	e.mu.Unlock()
+
+	if exists {
+		progress.update(progress.size, state)
+	}
+}
+
+// 中止所有进行中的边传边下，服务关闭时调用
+func (e *TransferEngine) abortAllProgress() {
+	e.mu.Lock()
+	progresses := e.progress
+	e.progress = make(map[string]*transferProgress)
+	e.stats = make(map[string]*transferStats)
+	for configPath := range e.files {
+		e.retireUploadFileLocked(configPath)
+	}
+	e.mu.Unlock()
+
+	for _, progress := range progresses {
+		progress.update(0, transferAborted)
+	}
+}
+
+// 获取进行中传输的进度记录，供边传边下使用
+func (e *TransferEngine) Watch(configPath string) (*transferProgress, error) {
+	configLock := resumableConfigLock(configPath)
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	config, err := loadResumableConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return e.progressLocked(configPath, config), nil
+}
+
+// 边传边下：先发送已连续完成的部分，然后随着分片写入继续发送，直到整个文件发送完毕。
+// 上传被取消、校验失败或长时间没有进展时中断连接，客户端会因长度不足而得知下载不完整
+func streamIncompleteFile(c *gin.Context, sessionID, fileName, configPath string) {
+	progress, err := transfers.Watch(configPath)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+		return
+	}
+
+	tempFilePath := storagePath(sessionID, fileName)
+	file, err := os.Open(tempFilePath)
+	if err != nil {
+		log.Printf("打开正在上传的文件失败: %v", err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+		return
+	}
+	defer file.Close()
+
+	log.Printf("开始边传边下: 会话ID=%s, 文件名=%s", sessionID, fileName)
+
+	c.Header("Content-Description", "File Transfer")
+	c.Header("Content-Transfer-Encoding", "binary")
+	c.Header("Content-Disposition", contentDisposition(fileName))
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Length", strconv.FormatInt(progress.size, 10))
+	c.Header("X-Transfer-Streaming", "true")
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(streamCheckInterval)
+	defer ticker.Stop()
+
+	var sent int64
+	for sent < progress.size {
+		ready, state, changed := progress.snapshot()
+		if state == transferAborted {
+			log.Printf("上传已中止，结束边传边下: %s", fileName)
+			return
+		}
+
+		if ready > sent {
+			n, err := io.Copy(c.Writer, io.NewSectionReader(file, sent, ready-sent))
+			sent += n
+			if err != nil {
+				log.Printf("边传边下写入失败: %v", err)
+				return
+			}
+			c.Writer.Flush()
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-c.Request.Context().Done():
+			log.Printf("下载方断开连接，结束边传边下: %s", fileName)
+			return
+		case <-ticker.C:
+			// 上传被删除或会话被清理时不会有新的进度
+			if !transferStillExists(sessionID, fileName, configPath) {
+				log.Printf("上传已不存在，结束边传边下: %s", fileName)
+				return
+			}
+		}
+	}
+
+	log.Printf("边传边下完成: %s (%d 字节)", fileName, sent)
+
+	// 等待上传通过完成校验后再记录下载，校验失败时已发送的内容不算完整下载。
+	// 下载方收到全部内容后可能立即断开，因此这里不再检查请求是否结束
+	for {
+		_, state, changed := progress.snapshot()
+		switch state {
+		case transferDone:
+			recordDownload(c, sessionID, fileName, sent, true)
+			return
+		case transferAborted:
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+			if !transferStillExists(sessionID, fileName, configPath) {
+				return
+			}
+		}
+	}
+}
+
+// 上传是否仍在进行或已完成
+func transferStillExists(sessionID, fileName, configPath string) bool {
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.RLock()
+	_, received := session.ReceivedFiles[fileName]
+	session.mu.RUnlock()
+	if received {
+		return true
+	}
+
+	_, err := os.Stat(configPath)
+	return err == nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 定向传输最多可以指定的接收方数量
+const maxRecipients = 32
+
+// 规范化接收方客户端ID列表：校验格式、去重并排序。返回空列表表示发送给会话中的所有人
+func normalizeRecipients(ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool, len(ids))
+	recipients := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if err := validateSessionID(id); err != nil {
+			return nil, fmt.Errorf("接收方客户端ID无效: %v", err)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		recipients = append(recipients, id)
+	}
+	if len(recipients) > maxRecipients {
+		return nil, fmt.Errorf("接收方不能超过 %d 个", maxRecipients)
+	}
+
+	sort.Strings(recipients)
+	return recipients, nil
+}
+
+// 客户端是否可以看到定向给recipients的内容：未指定接收方时所有人可见，否则只有接收方和发送方可见
+func canAccess(recipients []string, senderID, clientID string) bool {
+	if len(recipients) == 0 {
+		return true
+	}
+	if clientID == "" {
+		return false
+	}
+	if clientID == senderID {
+		return true
+	}
+	for _, id := range recipients {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// 文件上传者的客户端ID，未记录上传者时为空
+func (f *FileInfo) uploaderID() string {
+	return f.UploadedBy.clientID()
+}
+
+// 客户端是否可以访问文件
+func (f *FileInfo) accessibleBy(clientID string) bool {
+	return canAccess(f.Recipients, f.uploaderID(), clientID)
+}
+
+// 把定向消息发送给接收方和发送方的所有连接，未指定接收方时广播给所有客户端。调用方需持有会话锁
+func broadcastToRecipients(message interface{}, session *Session, recipients []string, senderID string) {
+	if len(recipients) == 0 {
+		broadcastMessage(message, session)
+		return
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println("marshal failed:", err)
+		return
+	}
+	fanOut(newOutboundMessage(message, data), session, recipients, senderID)
+}
+
+// 绑定客户端ID和客户端密钥：同一会话中第一次出现的客户端ID登记其密钥，之后使用该ID的连接必须提供相同的密钥，
+// 否则分配新的客户端ID，避免他人冒用在线列表中公开的ID查看定向内容。返回客户端应保存的密钥。调用方需持有会话锁
+func (s *Session) bindClientKey(info *ClientInfo, key string) string {
+	if validateSessionID(key) != nil {
+		key = generateUUID()
+	}
+
+	if registered, exists := s.ClientKeys[info.ID]; exists && !keysEqual(registered, key) {
+		log.Printf("客户端ID %s 的密钥不匹配，分配新的客户端ID", info.ID)
+		info.ID = generateUUID()
+	}
+	if s.ClientKeys[info.ID] != key {
+		s.ClientKeys[info.ID] = key
+		s.setMeta(metaPrefixKey+info.ID, key)
+	}
+	return key
+}
+
+// 校验客户端ID和密钥。调用方需持有会话锁
+func (s *Session) authenticate(clientID, key string) bool {
+	registered, exists := s.ClientKeys[clientID]
+	return exists && key != "" && keysEqual(registered, key)
+}
+
+func keysEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// 从HTTP请求的查询参数clientID和clientKey中识别客户端，校验失败时返回空字符串。调用方需持有会话锁
+func requestClientID(c *gin.Context, session *Session) string {
+	clientID := c.Query("clientID")
+	if clientID == "" || !session.authenticate(clientID, c.Query("clientKey")) {
+		return ""
+	}
+	return clientID
+}
+
+// 读取进行中上传的上传者和接收方
+func pendingAudience(configPath string) (senderID string, recipients []string, err error) {
+	configLock := resumableConfigLock(configPath)
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	config, err := loadResumableConfig(configPath)
+	if err != nil {
+		return "", nil, err
+	}
+	if config.Uploader != nil {
+		senderID = config.Uploader.ID
+	}
+	return senderID, config.Recipients, nil
+}
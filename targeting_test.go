@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeRecipients(t *testing.T) {
+	tooMany := make([]string, maxRecipients+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("client-%02d", i)
+	}
+
+	for _, test := range []struct {
+		ids  []string
+		want []string
+		ok   bool
+	}{
+		{nil, nil, true},
+		{[]string{}, nil, true},
+		{[]string{"b", "a", "b"}, []string{"a", "b"}, true},
+		{append(tooMany[:maxRecipients:maxRecipients], tooMany[0]), tooMany[:maxRecipients], true}, // 去重后不超过上限
+		{tooMany, nil, false},
+		{[]string{"a", ""}, nil, false},
+		{[]string{"a", "b_c"}, nil, false},
+	} {
+		got, err := normalizeRecipients(test.ids)
+		if (err == nil) != test.ok {
+			t.Errorf("normalizeRecipients(%q) 返回 %v，期望成功: %v", test.ids, err, test.ok)
+			continue
+		}
+		if test.ok && strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("normalizeRecipients(%q) = %q，期望 %q", test.ids, got, test.want)
+		}
+	}
+}
+
+func TestCanAccess(t *testing.T) {
+	for _, test := range []struct {
+		recipients []string
+		senderID   string
+		clientID   string
+		want       bool
+	}{
+		{nil, "", "", true},
+		{nil, "alice", "bob", true},
+		{[]string{"bob"}, "alice", "bob", true},
+		{[]string{"bob"}, "alice", "alice", true},
+		{[]string{"bob"}, "alice", "carol", false},
+		{[]string{"bob"}, "alice", "", false},
+		{[]string{"bob"}, "", "", false}, // 没有记录发送方时匿名请求不能冒充发送方
+		{[]string{"bob", "carol"}, "", "carol", true},
+	} {
+		if got := canAccess(test.recipients, test.senderID, test.clientID); got != test.want {
+			t.Errorf("canAccess(%q, %q, %q) = %v，期望 %v", test.recipients, test.senderID, test.clientID, got, test.want)
+		}
+	}
+}
+
+// 第一次出现的客户端ID登记密钥，之后密钥不一致时分配新的客户端ID
+func TestBindClientKey(t *testing.T) {
+	session := &Session{ID: "bindkey1", ClientKeys: make(map[string]string)}
+
+	for _, step := range []struct {
+		name    string
+		id      string
+		key     string
+		keepID  bool // 客户端ID保持不变
+		keepKey bool // 返回客户端提供的密钥
+	}{
+		{"新客户端登记密钥", "alice", "key-a", true, true},
+		{"相同密钥重新连接", "alice", "key-a", true, true},
+		{"冒用已登记的ID", "alice", "key-b", false, true},
+		{"没有密钥时生成密钥", "bob", "", true, false},
+		{"非法的密钥被替换", "carol", "key with spaces", true, false},
+	} {
+		info := &ClientInfo{ID: step.id}
+		key := session.bindClientKey(info, step.key)
+
+		if (info.ID == step.id) != step.keepID {
+			t.Fatalf("%s: 客户端ID变为 %s", step.name, info.ID)
+		}
+		if (key == step.key) != step.keepKey || validateSessionID(key) != nil {
+			t.Fatalf("%s: 返回的密钥为 %q", step.name, key)
+		}
+		if !session.authenticate(info.ID, key) {
+			t.Fatalf("%s: 绑定后无法通过身份校验", step.name)
+		}
+	}
+
+	// 冒用者没有取得原ID的身份
+	if session.authenticate("alice", "key-b") || !session.authenticate("alice", "key-a") {
+		t.Fatal("冒用者修改了已登记的密钥")
+	}
+	for _, test := range []struct{ id, key string }{
+		{"alice", ""},
+		{"unknown", "key-a"},
+		{"", ""},
+	} {
+		if session.authenticate(test.id, test.key) {
+			t.Errorf("authenticate(%q, %q) 通过了校验", test.id, test.key)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// 计算传输速度使用的时间窗口，上传停顿时每隔一个窗口仍广播一次，让接收方看到速度下降
+const throughputWindow = 10 * time.Second
+
+// 超过此时间没有新分片的上传不再广播进度（上传可能已被放弃或清理）
+const throughputIdleTimeout = 5 * time.Minute
+
+// 分片到达时记录的已接收字节数
+type throughputSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// 进行中上传的速度统计，用于向会话成员广播传输进度
+type transferStats struct {
+	sessionID  string
+	fileName   string
+	size       int64
+	uploader   *ClientInfo
+	recipients []string
+
+	received  int64
+	samples   []throughputSample // 时间窗口内的采样，按时间排序
+	updatedAt time.Time
+	sentAt    time.Time // 上次广播的时间
+}
+
+// transfer_progress消息的数据
+type transferProgressData struct {
+	Received int64   `json:"received"`
+	Progress float64 `json:"progress"` // 百分比
+	Speed    int64   `json:"speed"`    // 字节/秒
+	ETA      int64   `json:"eta"`      // 预计剩余秒数，无法估计时为-1
+}
+
+// 分片写入后记录一次采样。调用方需持有配置文件锁
+func (e *TransferEngine) recordThroughput(configPath string, config *ResumableFileConfig) {
+	now := time.Now()
+	received := config.completedBytes()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	stats, exists := e.stats[configPath]
+	if !exists {
+		stats = &transferStats{
+			sessionID:  config.SessionID,
+			fileName:   config.FileName,
+			size:       config.FileSize,
+			uploader:   config.Uploader,
+			recipients: config.Recipients,
+		}
+		e.stats[configPath] = stats
+	}
+	stats.record(now, received)
+}
+
+// 添加采样并丢弃时间窗口之外的旧采样（至少保留一个作为计算起点）
+func (s *transferStats) record(now time.Time, received int64) {
+	s.received = received
+	s.updatedAt = now
+	s.samples = append(s.samples, throughputSample{at: now, bytes: received})
+
+	cutoff := now.Add(-throughputWindow)
+	drop := 0
+	for drop < len(s.samples)-2 && s.samples[drop+1].at.Before(cutoff) {
+		drop++
+	}
+	s.samples = s.samples[drop:]
+}
+
+// 根据时间窗口内的采样计算速度和剩余时间
+func (s *transferStats) snapshot(now time.Time) transferProgressData {
+	data := transferProgressData{
+		Received: s.received,
+		Progress: 100,
+		ETA:      -1,
+	}
+	if s.size > 0 {
+		data.Progress = float64(s.received) / float64(s.size) * 100
+	}
+
+	if len(s.samples) >= 2 {
+		first := s.samples[0]
+		// 计算到当前时间，上传停顿时速度会逐渐下降
+		elapsed := now.Sub(first.at).Seconds()
+		if elapsed > 0 {
+			data.Speed = int64(float64(s.received-first.bytes) / elapsed)
+		}
+	}
+	if data.Speed > 0 {
+		data.ETA = (s.size - s.received + data.Speed - 1) / data.Speed
+	}
+	return data
+}
+
+// 定期向会话成员广播进行中上传的进度、速度和剩余时间。
+// 只广播自上次广播后有新分片到达或停顿超过一个时间窗口的上传，定向传输只发送给接收方和上传者
+func (e *TransferEngine) broadcastProgressLoop(interval time.Duration) {
+	if interval <= 0 {
+		log.Printf("传输进度广播已禁用")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		e.broadcastProgress(now)
+	}
+}
+
+// 广播一轮传输进度
+func (e *TransferEngine) broadcastProgress(now time.Time) {
+	type update struct {
+		stats *transferStats
+		data  transferProgressData
+	}
+
+	e.mu.Lock()
+	updates := make([]update, 0, len(e.stats))
+	for configPath, stats := range e.stats {
+		if now.Sub(stats.updatedAt) > throughputIdleTimeout {
+			delete(e.stats, configPath)
+			continue
+		}
+		if !stats.updatedAt.After(stats.sentAt) && now.Sub(stats.sentAt) < throughputWindow {
+			continue
+		}
+		stats.sentAt = now
+		updates = append(updates, update{stats: stats, data: stats.snapshot(now)})
+	}
+	e.mu.Unlock()
+
+	for _, u := range updates {
+		session := store.GetOrCreateSession(u.stats.sessionID)
+		session.mu.Lock()
+		broadcastToRecipients(Message{
+			Type:      "transfer_progress",
+			Name:      u.stats.fileName,
+			Size:      u.stats.size,
+			SessionID: u.stats.sessionID,
+			Timestamp: now,
+			From:      u.stats.uploader,
+			To:        u.stats.recipients,
+			Data:      u.data,
+		}, session, u.stats.recipients, u.stats.uploader.clientID())
+		session.mu.Unlock()
+	}
+}
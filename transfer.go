@@ -0,0 +1,574 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文件传输引擎：HTTP断点续传和WebSocket上传共用同一套状态、分片记录、校验和完成广播。
+// 传输状态持久化在断点续传配置文件中，因此两种方式都支持断点续传、秒传和重启恢复
+type TransferEngine struct {
+	ChunkSize    int64 // 默认分片大小，WebSocket分块上传未指定块大小时使用
+	MinChunkSize int64 // 客户端建议和服务端建议的分片大小的范围
+	MaxChunkSize int64
+
+	mu       sync.Mutex
+	progress map[string]*transferProgress // 配置文件路径 -> 可下载进度，用于边传边下
+	stats    map[string]*transferStats    // 配置文件路径 -> 速度统计，用于广播传输进度
+	files    map[string]*uploadFile       // 配置文件路径 -> 分片共享的文件句柄
+}
+
+var transfers = &TransferEngine{
+	ChunkSize:    ChunkSize,
+	MinChunkSize: ChunkSize,
+	MaxChunkSize: ChunkSize,
+	progress:     make(map[string]*transferProgress),
+	stats:        make(map[string]*transferStats),
+	files:        make(map[string]*uploadFile),
+}
+
+// 传输引擎返回的错误，附带HTTP状态码和额外的响应字段
+type TransferError struct {
+	Status  int
+	Message string
+	Fields  gin.H
+}
+
+func (e *TransferError) Error() string {
+	return e.Message
+}
+
+// 转换为HTTP响应体
+func (e *TransferError) Response() gin.H {
+	response := gin.H{"error": e.Message}
+	for key, value := range e.Fields {
+		response[key] = value
+	}
+	return response
+}
+
+func newTransferError(status int, message string) *TransferError {
+	return &TransferError{Status: status, Message: message}
+}
+
+// 开始传输的结果
+type TransferStart struct {
+	UploadID      string
+	ChunkSize     int64
+	TotalChunks   int
+	MissingChunks []int
+	ConfigPath    string
+	Completed     bool
+	Existing      *FileInfo // 会话中已有同名文件
+	Deduplicated  bool      // 秒传
+	Resumed       bool      // 从已有的上传配置继续并直接完成
+}
+
+// 开始（或继续）一次传输：会话中已有同名文件时直接返回，服务器上有相同内容时秒传，
+// 已有未完成的同一文件上传时从断点继续，否则创建新的上传配置和临时文件
+func (e *TransferEngine) Begin(req UploadStartRequest) (*TransferStart, error) {
+	fileName, err := normalizeUploadTarget(req.SessionID, req.FileName)
+	if err != nil {
+		return nil, newTransferError(http.StatusBadRequest, err.Error())
+	}
+	req.FileName = fileName
+	if req.FileSize < 0 || req.FileSize > MaxFileSize {
+		return nil, newTransferError(http.StatusBadRequest, "文件大小无效")
+	}
+	if req.To, err = normalizeRecipients(req.To); err != nil {
+		return nil, newTransferError(http.StatusBadRequest, err.Error())
+	}
+
+	// 检查文件是否已经存在于会话中
+	session := store.GetOrCreateSession(req.SessionID)
+	session.mu.RLock()
+	existingFile, exists := session.ReceivedFiles[req.FileName]
+	session.mu.RUnlock()
+	if exists {
+		log.Printf("文件 %s 已经存在于会话中，返回已完成状态", req.FileName)
+		return &TransferStart{
+			UploadID:      req.SessionID, // 使用sessionID作为uploadID
+			TotalChunks:   1,
+			ChunkSize:     existingFile.Size,
+			MissingChunks: []int{},
+			Completed:     true,
+			Existing:      existingFile,
+		}, nil
+	}
+
+	// 生成上传ID
+	uploadID := generateUUID()
+	uploader := resolveUploader(req.SessionID, req.ClientID)
+
+	configPath := resumableConfigPath(req.SessionID, req.FileName)
+	configLock := resumableConfigLock(configPath)
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	// 其他节点正在处理的同名上传不能被继续或覆盖
+	if config, err := loadResumableConfig(configPath); err == nil && config.ownedByOtherNode() {
+		return nil, errUploadOnOtherNode(config)
+	}
+
+	// 服务器上已有相同内容时直接链接到当前会话，无需重新上传
+	if hash, ok := contentHashKey(req.FileHash); ok {
+		if start := e.linkExisting(&req, hash, uploadID, configPath, uploader); start != nil {
+			return start, nil
+		}
+	}
+
+	// 同一文件已有未完成的上传（例如服务重启前）时从断点继续
+	if start := e.resume(&req, uploadID, configPath); start != nil {
+		return start, nil
+	}
+
+	return e.create(&req, uploadID, configPath, uploader)
+}
+
+// 秒传：将内容索引中已有的相同文件链接到会话，调用方需持有配置文件锁
+func (e *TransferEngine) linkExisting(req *UploadStartRequest, hash, uploadID, configPath string, uploader *ClientInfo) *TransferStart {
+	tempFilePath := storagePath(req.SessionID, req.FileName)
+
+	linked, err := contents.linkInto(hash, req.FileSize, tempFilePath)
+	if err != nil {
+		log.Printf("秒传链接文件失败，改为普通上传: %v", err)
+		return nil
+	}
+	if !linked {
+		return nil
+	}
+
+	// 丢弃同名文件之前未完成的上传配置
+	if err := removeResumableConfig(configPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除配置文件失败 %s: %v", configPath, err)
+	}
+	e.finishProgress(configPath, transferAborted)
+
+	log.Printf("⚡ 秒传: %s (哈希 %s)", req.FileName, hash)
+	e.publish(req.SessionID, &FileInfo{
+		Name:         req.FileName,
+		Size:         req.FileSize,
+		TempFilePath: tempFilePath,
+		UploadedBy:   uploader,
+		Recipients:   req.To,
+	})
+
+	chunkSize := e.chunkSizeFor(req.FileSize, req.ChunkSize)
+	return &TransferStart{
+		UploadID:      uploadID,
+		ChunkSize:     chunkSize,
+		TotalChunks:   int((req.FileSize + chunkSize - 1) / chunkSize),
+		MissingChunks: []int{},
+		Completed:     true,
+		Deduplicated:  true,
+	}
+}
+
+// 已有大小和哈希一致的上传配置时从断点继续，调用方需持有配置文件锁
+func (e *TransferEngine) resume(req *UploadStartRequest, uploadID, configPath string) *TransferStart {
+	config, err := loadResumableConfig(configPath)
+	if err != nil {
+		return nil
+	}
+	// 没有整个文件的哈希时无法确认已写入的分片属于同一文件（例如同名同大小的旧上传），只能重新开始
+	if config.FileHash == "" || req.FileHash == "" {
+		log.Printf("文件 %s 未提供哈希，重新开始上传", req.FileName)
+		return nil
+	}
+	if config.FileSize != req.FileSize || !strings.EqualFold(config.FileHash, req.FileHash) {
+		log.Printf("文件 %s 的已有上传配置与请求不一致，重新开始上传", req.FileName)
+		return nil
+	}
+	if _, err := os.Stat(config.TempFilePath); err != nil {
+		return nil
+	}
+
+	e.trackPending(req.SessionID, req.FileName, configPath)
+
+	missing := missingChunks(config)
+	log.Printf("继续上传文件 %s，缺失分片数: %d/%d", req.FileName, len(missing), config.TotalChunks)
+
+	start := &TransferStart{
+		UploadID:      uploadID,
+		ChunkSize:     config.ChunkSize,
+		TotalChunks:   config.TotalChunks,
+		MissingChunks: missing,
+		ConfigPath:    configPath,
+	}
+
+	// 所有分片都已写入，只差完成步骤
+	if len(missing) == 0 {
+		failedChunks, err := e.finalize(req.SessionID, req.FileName, configPath, config)
+		if err != nil {
+			log.Printf("文件 %s 完成校验失败: %v", req.FileName, err)
+			if len(failedChunks) == 0 {
+				// 整个文件的哈希不一致，只能重新上传
+				return nil
+			}
+			start.MissingChunks = failedChunks
+			return start
+		}
+		start.Completed = true
+		start.Resumed = true
+		return start
+	}
+
+	e.announce(req.SessionID, config.fileInfo())
+	return start
+}
+
+// 创建新的上传配置并预分配临时文件，调用方需持有配置文件锁
+func (e *TransferEngine) create(req *UploadStartRequest, uploadID, configPath string, uploader *ClientInfo) (*TransferStart, error) {
+	// 确定分片大小并计算总分片数
+	chunkSize := e.chunkSizeFor(req.FileSize, req.ChunkSize)
+	totalChunks := int((req.FileSize + chunkSize - 1) / chunkSize)
+
+	// 添加详细的文件信息日志
+	log.Printf("开始处理文件: %s", req.FileName)
+	log.Printf("文件大小: %d 字节 (%.2f GB)", req.FileSize, float64(req.FileSize)/1024/1024/1024)
+	log.Printf("分片大小: %d 字节", chunkSize)
+	log.Printf("计算分片数: %d", totalChunks)
+
+	// 创建配置文件
+	config := &ResumableFileConfig{
+		SessionID:    req.SessionID,
+		FileName:     req.FileName,
+		FileSize:     req.FileSize,
+		FileHash:     req.FileHash,
+		ChunkSize:    chunkSize,
+		TotalChunks:  totalChunks,
+		Completed:    newChunkBitmap(totalChunks),
+		ChunkHashes:  make([]string, totalChunks),
+		TempFilePath: storagePath(req.SessionID, req.FileName),
+		Uploader:     uploader,
+		Recipients:   req.To,
+		Node:         uploadNode(),
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+
+	// 覆盖同名文件之前的上传时，正在边传边下的下载不再有效
+	e.finishProgress(configPath, transferAborted)
+
+	// 保存配置文件（使用sessionID保持与源文件一致）
+	if err := saveResumableConfig(configPath, config); err != nil {
+		log.Printf("保存配置文件失败: %v", err)
+		return nil, newTransferError(http.StatusInternalServerError, "保存配置文件失败")
+	}
+
+	// 创建临时文件并预分配空间。存储路径可能是秒传时创建的硬链接（例如服务重启后会话信息丢失而链接仍在磁盘上），
+	// 先删除再创建，不能原地截断与其他会话共享的内容
+	if err := os.Remove(config.TempFilePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除旧的临时文件失败: %v", err)
+		return nil, newTransferError(http.StatusInternalServerError, "创建临时文件失败")
+	}
+	tempFile, err := os.Create(config.TempFilePath)
+	if err != nil {
+		log.Printf("创建临时文件失败: %v", err)
+		return nil, newTransferError(http.StatusInternalServerError, "创建临时文件失败")
+	}
+
+	// 预分配文件空间
+	if err := tempFile.Truncate(req.FileSize); err != nil {
+		log.Printf("预分配文件空间失败: %v", err)
+		tempFile.Close()
+		return nil, newTransferError(http.StatusInternalServerError, "预分配文件空间失败")
+	}
+	tempFile.Close()
+
+	e.trackPending(req.SessionID, req.FileName, configPath)
+	e.announce(req.SessionID, config.fileInfo())
+
+	return &TransferStart{
+		UploadID:      uploadID,
+		ChunkSize:     chunkSize,
+		TotalChunks:   totalChunks,
+		MissingChunks: missingChunks(config),
+		ConfigPath:    configPath,
+	}, nil
+}
+
+// 写入分片的结果
+type ChunkResult struct {
+	ChunkIndex    int
+	Completed     bool
+	Progress      float64
+	MissingChunks []int
+}
+
+// 写入一个分片：从r中流式读取分片数据写入临时文件的对应位置，同时计算哈希，不把整个分片读入内存。
+// 校验大小和客户端提供的摘要，记录分片哈希，所有分片完成后自动完成传输。
+// hashAlgorithm为记录分片哈希使用的算法，expectedDigest为空时不做比对
+func (e *TransferEngine) WriteChunk(sessionID, fileName string, chunkIndex int, r io.Reader, hashAlgorithm, expectedDigest string) (*ChunkResult, error) {
+	fileName, err := normalizeUploadTarget(sessionID, fileName)
+	if err != nil {
+		return nil, newTransferError(http.StatusBadRequest, err.Error())
+	}
+	hasher, err := newChunkHasher(hashAlgorithm)
+	if err != nil {
+		return nil, newTransferError(http.StatusBadRequest, err.Error())
+	}
+
+	// 在配置文件读锁内读取分片位置并获取文件句柄。读取和写入分片数据可能很慢（取决于客户端的网速），
+	// 期间不持有配置文件锁，同一文件的不同分片通过共享的文件句柄并行写入
+	configPath := resumableConfigPath(sessionID, fileName)
+	configLock := resumableConfigLock(configPath)
+	configLock.RLock()
+	config, err := loadResumableConfig(configPath)
+	if err != nil {
+		configLock.RUnlock()
+		log.Printf("加载配置文件失败: %v", err)
+		return nil, newTransferError(http.StatusNotFound, "上传配置不存在")
+	}
+
+	if config.ownedByOtherNode() {
+		configLock.RUnlock()
+		return nil, errUploadOnOtherNode(config)
+	}
+	if chunkIndex < 0 || chunkIndex >= config.TotalChunks {
+		configLock.RUnlock()
+		return nil, newTransferError(http.StatusBadRequest, "分片索引超出范围")
+	}
+	if config.Paused {
+		configLock.RUnlock()
+		return nil, errUploadPaused(chunkIndex)
+	}
+	if config.chunkCompleted(chunkIndex) {
+		// 分片已完成，返回成功
+		progress := calculateProgress(config)
+		configLock.RUnlock()
+		return &ChunkResult{
+			ChunkIndex: chunkIndex,
+			Completed:  false,
+			Progress:   progress,
+		}, nil
+	}
+
+	offset, size := config.chunkRange(chunkIndex)
+	f, err := e.acquireUploadFile(sessionID, fileName, configPath, config)
+	configLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer e.releaseUploadFile(f)
+
+	// 边写入边计算哈希。数据不完整或校验失败时分片不会被标记为完成，重新上传时会被覆盖
+	written, err := writeChunkAt(f.file, offset, size, io.TeeReader(r, hasher))
+	if err != nil {
+		log.Printf("写入分片失败: %v", err)
+		return nil, err
+	}
+	if written != size {
+		return nil, newTransferError(http.StatusBadRequest, "分片大小不匹配")
+	}
+
+	chunkHash := hex.EncodeToString(hasher.Sum(nil))
+	if expectedDigest != "" && chunkHash != expectedDigest {
+		log.Printf("分片 %d 校验失败: 算法 %s, 期望 %s, 实际 %s", chunkIndex, hashAlgorithm, expectedDigest, chunkHash)
+		return nil, &TransferError{
+			Status:  http.StatusUnprocessableEntity,
+			Message: "分片校验失败，请重新上传该分片",
+			Fields: gin.H{
+				"chunkIndex": chunkIndex,
+				"retryable":  true,
+			},
+		}
+	}
+
+	// 同步文件并更新分片状态，与同时写入完成的其他分片一起提交
+	return e.commitChunk(f, &chunkCommit{
+		index:     chunkIndex,
+		algorithm: hashAlgorithm,
+		hash:      chunkHash,
+	})
+}
+
+// 显式完成传输，返回文件大小
+func (e *TransferEngine) Complete(sessionID, fileName string) (int64, error) {
+	fileName, err := normalizeUploadTarget(sessionID, fileName)
+	if err != nil {
+		return 0, newTransferError(http.StatusBadRequest, err.Error())
+	}
+
+	// 检查文件是否已经在会话中存在（可能已经完成）
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.RLock()
+	existingFile, exists := session.ReceivedFiles[fileName]
+	session.mu.RUnlock()
+	if exists {
+		log.Printf("文件 %s 已经存在于会话中，直接返回成功", fileName)
+		return existingFile.Size, nil
+	}
+
+	configPath := resumableConfigPath(sessionID, fileName)
+	configLock := resumableConfigLock(configPath)
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	config, err := loadResumableConfig(configPath)
+	if err != nil {
+		return 0, newTransferError(http.StatusNotFound, "上传配置不存在")
+	}
+	if config.ownedByOtherNode() {
+		return 0, errUploadOnOtherNode(config)
+	}
+
+	// 验证所有分片都已完成
+	if missing := missingChunks(config); len(missing) > 0 {
+		log.Printf("文件 %s 还有 %d 个分片未完成上传", fileName, len(missing))
+		return 0, &TransferError{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("还有 %d 个分片未完成上传", len(missing)),
+			Fields:  gin.H{"incompleteChunks": len(missing)},
+		}
+	}
+
+	if failedChunks, err := e.finalize(sessionID, fileName, configPath, config); err != nil {
+		log.Printf("文件 %s 完成校验失败: %v", fileName, err)
+		return 0, &TransferError{
+			Status:  http.StatusConflict,
+			Message: "文件完整性验证失败: " + err.Error(),
+			Fields: gin.H{
+				"missingChunks": failedChunks,
+				"retryable":     len(failedChunks) > 0,
+			},
+		}
+	}
+
+	log.Printf("文件上传完成并验证: %s", fileName)
+	return config.FileSize, nil
+}
+
+// 完成传输：重新校验所有分片哈希和文件哈希，通过后加入会话的已接收文件列表、删除配置文件并广播。
+// 调用方需持有配置文件锁。校验失败的分片会被标记为未完成，并返回其索引以便客户端重传
+func (e *TransferEngine) finalize(sessionID, fileName, configPath string, config *ResumableFileConfig) ([]int, error) {
+	// 重新校验每个分片在磁盘上的数据
+	failedChunks := make([]int, 0)
+	for i := 0; i < config.TotalChunks; i++ {
+		offset, size := config.chunkRange(i)
+		algorithm, hash := config.chunkHash(i)
+		if err := verifyChunkIntegrity(config.TempFilePath, offset, size, algorithm, hash); err != nil {
+			log.Printf("分片 %d 重新校验失败: %v", i, err)
+			config.resetChunk(i)
+			failedChunks = append(failedChunks, i)
+		}
+	}
+	if len(failedChunks) > 0 {
+		config.UpdatedAt = time.Now()
+		if err := saveChunkState(configPath, config, failedChunks...); err != nil {
+			log.Printf("保存配置文件失败: %v", err)
+		}
+		// 已经发送给边传边下的数据可能有误，中断这些下载
+		e.finishProgress(configPath, transferAborted)
+		return failedChunks, fmt.Errorf("%d 个分片校验失败", len(failedChunks))
+	}
+
+	// 验证文件完整性（可选），校验通过的SHA-256哈希登记到内容索引供秒传使用
+	if config.FileHash != "" {
+		if err := verifyFileHash(config.TempFilePath, config.FileHash); err != nil {
+			e.finishProgress(configPath, transferAborted)
+			return nil, err
+		}
+		if hash, ok := contentHashKey(config.FileHash); ok {
+			contents.add(hash, config.FileSize, config.TempFilePath)
+		}
+	}
+
+	// 上传完成后删除配置文件
+	if err := removeResumableConfig(configPath); err != nil {
+		log.Printf("删除配置文件失败 %s: %v", configPath, err)
+	} else {
+		log.Printf("已删除配置文件: %s", configPath)
+	}
+
+	e.publish(sessionID, config.fileInfo())
+	e.finishProgress(configPath, transferDone)
+	return nil, nil
+}
+
+// 通知会话中的客户端有文件开始上传，接收方可以立即开始边传边下。定向传输只通知接收方和上传者
+func (e *TransferEngine) announce(sessionID string, file *FileInfo) {
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	broadcastToRecipients(Message{
+		Type:      "file_incoming",
+		Name:      file.Name,
+		Size:      file.Size,
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+		From:      file.UploadedBy,
+		To:        file.Recipients,
+	}, session, file.Recipients, file.uploaderID())
+}
+
+// 将已完成的文件加入会话的已接收文件列表，并通过WebSocket通知接收端
+func (e *TransferEngine) publish(sessionID string, file *FileInfo) {
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.ReceivedFiles[file.Name] = file
+	delete(session.PendingUploads, file.Name)
+	session.saveFileMeta(file)
+	session.deleteMeta(metaPrefixUpload + file.Name)
+
+	log.Printf("🎉 文件上传完成: %s (大小: %d 字节)", file.Name, file.Size)
+
+	message := Message{
+		Type:      "file",
+		Content:   fmt.Sprintf("文件上传完成: %s", file.Name),
+		Name:      file.Name,
+		Size:      file.Size,
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+		Stored:    true,
+		Data:      "文件已保存在服务器上，可通过下载链接获取",
+		From:      file.UploadedBy,
+		To:        file.Recipients,
+	}
+
+	// 广播消息到会话中的所有客户端，定向传输只发送给接收方和上传者
+	broadcastToRecipients(message, session, file.Recipients, file.uploaderID())
+}
+
+// 上传配置对应的文件信息
+func (config *ResumableFileConfig) fileInfo() *FileInfo {
+	return &FileInfo{
+		Name:         config.FileName,
+		Size:         config.FileSize,
+		TempFilePath: config.TempFilePath,
+		UploadedBy:   config.Uploader,
+		Recipients:   config.Recipients,
+	}
+}
+
+// 记录会话中进行中的上传
+func (e *TransferEngine) trackPending(sessionID, fileName, configPath string) {
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.Lock()
+	session.PendingUploads[fileName] = configPath
+	session.setMeta(metaPrefixUpload+fileName, configPath)
+	session.mu.Unlock()
+}
+
+// 按顺序返回未完成的分片索引
+func missingChunks(config *ResumableFileConfig) []int {
+	missing := make([]int, 0)
+	for i := 0; i < config.TotalChunks; i++ {
+		if !config.chunkCompleted(i) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
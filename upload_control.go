@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 暂停期间写入分片返回的错误，客户端应等待上传继续后再上传
+func errUploadPaused(chunkIndex int) *TransferError {
+	return &TransferError{
+		Status:  http.StatusLocked,
+		Message: "上传已暂停",
+		Fields: gin.H{
+			"chunkIndex": chunkIndex,
+			"paused":     true,
+		},
+	}
+}
+
+// 取消进行中的上传：删除临时文件和上传配置，中断边传边下，并通知会话中的客户端。
+// clientID为发起取消的客户端，定向传输只有接收方和上传者可以取消
+func (e *TransferEngine) Cancel(sessionID, fileName, clientID string) error {
+	configPath := resumableConfigPath(sessionID, fileName)
+	configLock := resumableConfigLock(configPath)
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	config, err := loadResumableConfig(configPath)
+	if err != nil || !config.fileInfo().accessibleBy(clientID) {
+		return newTransferError(http.StatusNotFound, "上传不存在")
+	}
+	if config.ownedByOtherNode() {
+		return errUploadOnOtherNode(config)
+	}
+
+	// 正在写入的分片持有文件句柄，最后一个分片结束时关闭；之后提交时找不到上传配置而失败
+	if err := removeResumableConfig(configPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除配置文件失败 %s: %v", configPath, err)
+		return newTransferError(http.StatusInternalServerError, "取消上传失败")
+	}
+	if err := removeStoredFile(config.TempFilePath); err != nil {
+		log.Printf("删除临时文件失败 %s: %v", config.TempFilePath, err)
+	}
+	e.finishProgress(configPath, transferAborted)
+
+	actor := resolveUploader(sessionID, clientID)
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	delete(session.PendingUploads, fileName)
+	session.deleteMeta(metaPrefixUpload + fileName)
+	log.Printf("已取消上传: %s/%s", sessionID, fileName)
+
+	broadcastToRecipients(Message{
+		Type:      "upload_cancelled",
+		Name:      fileName,
+		Size:      config.FileSize,
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+		From:      actor,
+		To:        config.Recipients,
+	}, session, config.Recipients, config.fileInfo().uploaderID())
+	return nil
+}
+
+// 暂停或继续上传。暂停状态保存在上传配置中，对会话中的所有成员可见，服务重启后仍然有效；
+// 暂停期间写入分片返回423，已经开始写入的分片仍会完成。状态变化时通知会话中的客户端，返回当前进度
+func (e *TransferEngine) SetPaused(sessionID, fileName, clientID string, paused bool) (float64, error) {
+	configPath := resumableConfigPath(sessionID, fileName)
+	configLock := resumableConfigLock(configPath)
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	config, err := loadResumableConfig(configPath)
+	if err != nil || !config.fileInfo().accessibleBy(clientID) {
+		return 0, newTransferError(http.StatusNotFound, "上传不存在")
+	}
+	if config.ownedByOtherNode() {
+		return 0, errUploadOnOtherNode(config)
+	}
+	progress := calculateProgress(config)
+	if config.Paused == paused {
+		return progress, nil
+	}
+
+	actor := resolveUploader(sessionID, clientID)
+	config.Paused = paused
+	config.PausedBy = nil
+	config.PausedAt = nil
+	now := time.Now()
+	if paused {
+		config.PausedBy = actor
+		config.PausedAt = &now
+	}
+	config.UpdatedAt = now
+	if err := saveResumableConfig(configPath, config); err != nil {
+		log.Printf("保存配置文件失败: %v", err)
+		return 0, newTransferError(http.StatusInternalServerError, "保存配置文件失败")
+	}
+
+	messageType := "upload_resumed"
+	if paused {
+		messageType = "upload_paused"
+	}
+	log.Printf("上传 %s/%s 状态变更: %s", sessionID, fileName, messageType)
+
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	broadcastToRecipients(Message{
+		Type:      messageType,
+		Name:      fileName,
+		Size:      config.FileSize,
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+		Data:      gin.H{"progress": progress},
+		From:      actor,
+		To:        config.Recipients,
+	}, session, config.Recipients, config.fileInfo().uploaderID())
+	return progress, nil
+}
+
+// 解析上传控制请求中的会话ID、文件名和发起请求的客户端ID
+func uploadControlTarget(c *gin.Context) (sessionID, fileName, clientID string, ok bool) {
+	sessionID = c.Param("sessionID")
+	fileName, err := normalizeUploadTarget(sessionID, c.Param("fileName"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", "", "", false
+	}
+
+	session := store.GetOrCreateSession(sessionID)
+	session.mu.RLock()
+	clientID = requestClientID(c, session)
+	session.mu.RUnlock()
+	return sessionID, fileName, clientID, true
+}
+
+// 取消上传
+func cancelUpload(c *gin.Context) {
+	sessionID, fileName, clientID, ok := uploadControlTarget(c)
+	if !ok {
+		return
+	}
+
+	if err := transfers.Cancel(sessionID, fileName, clientID); err != nil {
+		respondTransferError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "上传已取消",
+		"fileName": fileName,
+	})
+}
+
+// 暂停上传
+func pauseUpload(c *gin.Context) {
+	setUploadPaused(c, true)
+}
+
+// 继续已暂停的上传
+func resumePausedUpload(c *gin.Context) {
+	setUploadPaused(c, false)
+}
+
+func setUploadPaused(c *gin.Context, paused bool) {
+	sessionID, fileName, clientID, ok := uploadControlTarget(c)
+	if !ok {
+		return
+	}
+
+	progress, err := transfers.SetPaused(sessionID, fileName, clientID, paused)
+	if err != nil {
+		respondTransferError(c, err)
+		return
+	}
+
+	message := "上传已继续"
+	if paused {
+		message = "上传已暂停"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":  message,
+		"fileName": fileName,
+		"paused":   paused,
+		"progress": progress,
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+)
+
+// 每个写入协程的任务队列长度，队列已满时提交任务的readPump会等待（对上传方形成背压）
+const diskWriterQueueSize = 16
+
+// 后台磁盘写入池：WebSocket上传的文件数据交给后台协程写入，readPump可以继续处理同一连接的文字、昵称等消息。
+// 同一文件的任务总是交给同一个协程，保证按到达顺序写入；不同文件可以并行写入
+type diskWriterPool struct {
+	queues []chan func()
+}
+
+// 全局磁盘写入池，在解析配置后创建
+var diskWriters *diskWriterPool
+
+func newDiskWriterPool(workers int) *diskWriterPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	pool := &diskWriterPool{queues: make([]chan func(), workers)}
+	for i := range pool.queues {
+		queue := make(chan func(), diskWriterQueueSize)
+		pool.queues[i] = queue
+		go func() {
+			for job := range queue {
+				job()
+			}
+		}()
+	}
+	log.Printf("磁盘写入池已启动，写入协程数: %d", workers)
+	return pool
+}
+
+// 提交写入任务，key相同的任务按提交顺序执行
+func (p *diskWriterPool) submit(key string, job func()) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	p.queues[h.Sum32()%uint32(len(p.queues))] <- job
+}